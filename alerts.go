@@ -3,15 +3,21 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/load"
 	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/net"
 	"github.com/spf13/viper"
 )
 
@@ -21,119 +27,597 @@ type Rule struct {
 	And       []Rule `mapstructure:"and"`
 	Or        []Rule `mapstructure:"or"`
 	Condition string `mapstructure:"condition"`
+
+	expr Expr
 }
 
+// clone returns a copy of the rule tree that shares no slices with r, so it
+// can be compiled without touching a tree the evaluator may be reading.
+func (r Rule) clone() Rule {
+	c := Rule{Condition: r.Condition, expr: r.expr}
+	for _, sub := range r.And {
+		c.And = append(c.And, sub.clone())
+	}
+	for _, sub := range r.Or {
+		c.Or = append(c.Or, sub.clone())
+	}
+	return c
+}
+
+// String renders the rule tree back into a single condition.
+func (r Rule) String() string {
+	if r.Condition != "" {
+		return r.Condition
+	}
+	subs, op := r.And, " and "
+	if len(subs) == 0 {
+		subs, op = r.Or, " or "
+	}
+	parts := make([]string, len(subs))
+	for i, sub := range subs {
+		parts[i] = sub.String()
+		if sub.Condition == "" {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, op)
+}
+
+// values returns the current value of every series the rule references
+// for one alert instance, keyed by series.
+func (r Rule) values(env *evalEnv) map[string]float64 {
+	out := make(map[string]float64)
+	for _, sel := range r.selectors() {
+		if key, ok := env.resolve(sel); ok && finite(env.metrics[key]) {
+			out[key] = env.metrics[key]
+		}
+	}
+	return out
+}
+
+// finite reports whether v can be encoded as JSON: NaN and the infinities
+// make json.Marshal fail.
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// selectors returns every metric selector in the rule tree.
+func (r Rule) selectors() []*metricExpr {
+	var out []*metricExpr
+	r.collectSelectors(&out)
+	return out
+}
+
+func (r Rule) empty() bool {
+	return r.Condition == "" && len(r.And) == 0 && len(r.Or) == 0
+}
+
+// usesAbsent reports whether any condition in the rule tree uses absent().
+func (r Rule) usesAbsent() bool {
+	if r.expr != nil && exprUsesAbsent(r.expr) {
+		return true
+	}
+	for _, sub := range r.And {
+		if sub.usesAbsent() {
+			return true
+		}
+	}
+	for _, sub := range r.Or {
+		if sub.usesAbsent() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) collectSelectors(out *[]*metricExpr) {
+	if r.expr != nil {
+		exprSelectors(r.expr, out)
+	}
+	for _, sub := range r.And {
+		sub.collectSelectors(out)
+	}
+	for _, sub := range r.Or {
+		sub.collectSelectors(out)
+	}
+}
+
+// Alert is one rule definition. When its condition selects labeled series
+// it fires one instance per series; Name and Message may then use those
+// labels as templates, e.g. "Disk {{.mount}} full". Severity, when set, is
+// also attached to every instance as the severity label.
+//
+// Resolve, Missing and Flapping tame noisy rules:
+//
+//	alerts:
+//	  - name: cpu_high
+//	    rule: {condition: cpu > 90}
+//	    resolve: {condition: cpu < 80}   # once firing, stay until this holds
+//	    missing: keep                    # ok, firing, keep or alert
+//	    flapping: {window: 10m, threshold: 4}
 type Alert struct {
-	Name string `mapstructure:"name"`
-	Rule Rule   `mapstructure:"rule"`
+	Name     string            `mapstructure:"name"`
+	For      time.Duration     `mapstructure:"for"`
+	Severity string            `mapstructure:"severity"`
+	Labels   map[string]string `mapstructure:"labels"`
+	Message  string            `mapstructure:"message"`
+	Rule     Rule              `mapstructure:"rule"`
+	Resolve  Rule              `mapstructure:"resolve"`
+	Missing  MissingPolicy     `mapstructure:"missing"`
+	Flapping FlappingConfig    `mapstructure:"flapping"`
+
+	nameTmpl    *template.Template
+	messageTmpl *template.Template
+}
+
+// MissingPolicy decides what a rule means when its metrics are missing.
+type MissingPolicy string
+
+const (
+	MissingOK     MissingPolicy = "ok"     // the rule does not hold (default)
+	MissingFiring MissingPolicy = "firing" // the rule holds
+	MissingKeep   MissingPolicy = "keep"   // the rule keeps its last result
+	MissingAlert  MissingPolicy = "alert"  // the rule holds, tagged nodata="true"
+)
+
+func (p MissingPolicy) valid() bool {
+	switch p {
+	case "", MissingOK, MissingFiring, MissingKeep, MissingAlert:
+		return true
+	}
+	return false
+}
+
+// FlappingConfig marks an alert as flapping once its rule changes result
+// Threshold times within Window. A flapping alert keeps the state it was
+// in, tagged flapping="true", until the changes drop below Threshold again.
+type FlappingConfig struct {
+	Window    time.Duration `mapstructure:"window"`
+	Threshold int           `mapstructure:"threshold"`
+}
+
+// severityLevels are the accepted values of Alert.Severity, most severe first.
+var severityLevels = []string{"critical", "warning", "info"}
+
+func validSeverity(s string) bool {
+	for _, level := range severityLevels {
+		if s == level {
+			return true
+		}
+	}
+	return false
 }
 
 type Config struct {
-	Alerts []Alert `mapstructure:"alerts"`
+	Alerts    []Alert          `mapstructure:"alerts"`
+	Sources   []SourceConfig   `mapstructure:"sources"`
+	Receivers []ReceiverConfig `mapstructure:"receivers"`
+	Routing   RoutingConfig    `mapstructure:"routing"`
+	History   HistoryConfig    `mapstructure:"history"`
+	Silences  []Silence        `mapstructure:"silences"`
+	Inhibit   []InhibitRule    `mapstructure:"inhibit_rules"`
+	API       APIConfig        `mapstructure:"api"`
+	Agents    AgentsConfig     `mapstructure:"agents"`
+	Agent     AgentConfig      `mapstructure:"agent"`
+	Baselines BaselineConfig   `mapstructure:"baselines"`
+
+	// windows is the longest history window each metric is read over and
+	// anomalies every anomaly function in use, both filled in by
+	// compileConfig.
+	windows   map[string]time.Duration
+	anomalies map[string]anomalySpec
 }
 
 // ---------------- UNIT PARSER ----------------
+//
+// Thresholds may carry a unit, which scales the number to the base unit of
+// its kind:
+//
+//	bytes     B, KB, MB, GB, TB (SI), KiB, MiB, GiB, TiB (IEC)
+//	bits      bit, Kbit, Mbit, Gbit and rates bps, Kbps, Mbps, Gbps,
+//	          converted to bytes (per second), so rate(net.rx_bytes[1m]) > 80Mbps
+//	percent   %, as published by the *_pct metrics (0-100)
+//	duration  ms, s, m, h, d, converted to seconds
+//	count     k, M (plain multipliers)
+//
+// Units are case-insensitive except m (minutes) and M (millions), and a
+// byte unit must end in an upper-case B: Mb or kb could mean bits, so they
+// are rejected; write MB for megabytes or Mbit for megabits. Numbers may
+// have an exponent, as in 1.5e6.
+
+type unitKind int
+
+const (
+	unitAny unitKind = iota // plain numbers and metrics of unknown unit
+	unitCount
+	unitBytes
+	unitPercent
+	unitSeconds
+)
 
-func parseWithUnits(val string) (float64, error) {
-	unitMap := map[string]float64{
-		"b":   1,
-		"kib": 1024,
-		"mib": 1024 * 1024,
-		"gib": 1024 * 1024 * 1024,
+func (k unitKind) String() string {
+	switch k {
+	case unitCount:
+		return "a count"
+	case unitBytes:
+		return "bytes"
+	case unitPercent:
+		return "percent"
+	case unitSeconds:
+		return "seconds"
 	}
+	return "a plain number"
+}
+
+// compatible reports whether values of kinds k and o may be compared or
+// added. A plain number goes with anything.
+func (k unitKind) compatible(o unitKind) bool {
+	return k == unitAny || o == unitAny || k == o
+}
+
+type unit struct {
+	factor float64
+	kind   unitKind
+}
+
+// caseUnits must match exactly; foldUnits ignore case.
+var (
+	caseUnits = map[string]unit{
+		"m": {60, unitSeconds},
+		"M": {1e6, unitAny},
+	}
+	foldUnits = map[string]unit{
+		"b":   {1, unitBytes},
+		"kb":  {1e3, unitBytes},
+		"mb":  {1e6, unitBytes},
+		"gb":  {1e9, unitBytes},
+		"tb":  {1e12, unitBytes},
+		"kib": {1 << 10, unitBytes},
+		"mib": {1 << 20, unitBytes},
+		"gib": {1 << 30, unitBytes},
+		"tib": {1 << 40, unitBytes},
+
+		"bit":  {1.0 / 8, unitBytes},
+		"kbit": {1e3 / 8, unitBytes},
+		"mbit": {1e6 / 8, unitBytes},
+		"gbit": {1e9 / 8, unitBytes},
+		"bps":  {1.0 / 8, unitBytes},
+		"kbps": {1e3 / 8, unitBytes},
+		"mbps": {1e6 / 8, unitBytes},
+		"gbps": {1e9 / 8, unitBytes},
+
+		"%": {1, unitPercent},
+
+		"ms": {0.001, unitSeconds},
+		"s":  {1, unitSeconds},
+		"h":  {3600, unitSeconds},
+		"d":  {86400, unitSeconds},
+
+		"k": {1e3, unitAny},
+	}
+)
+
+var quantityRe = regexp.MustCompile(`^((?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][+-]?[0-9]+)?)\s*([A-Za-z%]*)$`)
 
-	re := regexp.MustCompile(`(?i)([0-9.]+)\s*([a-zA-Z]*)`)
-	matches := re.FindStringSubmatch(val)
-	if len(matches) != 3 {
-		return 0, fmt.Errorf("invalid value format: %s", val)
+// parseWithUnits parses a number with an optional unit, e.g. 1.5GiB, 80%
+// or 250ms, into its base unit.
+func parseWithUnits(val string) (float64, unitKind, error) {
+	matches := quantityRe.FindStringSubmatch(strings.TrimSpace(val))
+	if matches == nil {
+		return 0, unitAny, fmt.Errorf("invalid number %q", val)
 	}
 
 	num, err := strconv.ParseFloat(matches[1], 64)
 	if err != nil {
-		return 0, err
+		return 0, unitAny, fmt.Errorf("invalid number %q", val)
 	}
 
-	unit := strings.ToLower(matches[2])
-	if unit == "" {
-		return num, nil
+	name := matches[2]
+	if name == "" {
+		return num, unitAny, nil
+	}
+	u, ok := caseUnits[name]
+	if !ok {
+		u, ok = foldUnits[strings.ToLower(name)]
 	}
-
-	factor, ok := unitMap[unit]
 	if !ok {
-		return 0, fmt.Errorf("unknown unit: %s", unit)
+		return 0, unitAny, fmt.Errorf("unknown unit %q in %q", name, val)
+	}
+	if u.kind == unitBytes && strings.HasSuffix(name, "b") {
+		// Bit units end in "bit" or "bps", so this is a byte unit.
+		return 0, unitAny, fmt.Errorf("ambiguous unit %q in %q: write B for bytes or bit for bits", name, val)
+	}
+	return num * u.factor, u.kind, nil
+}
+
+// metricUnit guesses the unit of a built-in metric from its name. Metrics
+// it does not recognise, such as most source metrics, may be compared with
+// anything.
+func metricUnit(name string) unitKind {
+	switch {
+	case strings.HasSuffix(name, "_pct"):
+		return unitPercent
+	case strings.HasSuffix(name, "_bytes"):
+		return unitBytes
+	case strings.HasSuffix(name, "_seconds"):
+		return unitSeconds
+	case strings.HasSuffix(name, "_cores"):
+		return unitCount
+	case strings.HasSuffix(name, "_packets"), strings.HasSuffix(name, "_errors"):
+		return unitCount
 	}
 
-	return num * factor, nil
+	switch name {
+	case "cpu", "load1", "load5", "load15", "fd.open", "fd.max", "agent.up":
+		return unitCount
+	case "memory", "memory.total", "memory.available", "swap.used", "swap.total":
+		return unitBytes
+	}
+	if rest := strings.TrimPrefix(name, "cpu."); rest != name && isAllDigits(rest) {
+		return unitPercent
+	}
+	if strings.HasPrefix(name, "process.") {
+		switch {
+		case strings.HasSuffix(name, ".rss"):
+			return unitBytes
+		case strings.HasSuffix(name, ".cpu"):
+			return unitPercent
+		case strings.HasSuffix(name, ".count"), strings.HasSuffix(name, ".open_files"), strings.HasSuffix(name, ".threads"):
+			return unitCount
+		}
+	}
+	if strings.HasPrefix(name, "disk.") {
+		for _, field := range []string{".used", ".free", ".total"} {
+			if strings.HasSuffix(name, field) {
+				return unitBytes
+			}
+		}
+	}
+	return unitAny
+}
+
+func isAllDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 // ---------------- RULE EVALUATOR ----------------
 
-func evalRule(rule Rule, metrics map[string]float64, ctx map[string]float64) bool {
+// ConfigError collects every problem found while validating rules.yaml.
+// Each entry is prefixed with the path of the offending node, e.g.
+// alerts[3].rule.and[1].
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+func (e *ConfigError) add(path, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (e *ConfigError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// compileRule parses every condition in the rule tree once so evaluation
+// never has to re-parse them.
+func compileRule(rule *Rule, path string, errs *ConfigError) {
+	set := 0
 	if rule.Condition != "" {
-		parts := strings.Fields(rule.Condition)
-		if len(parts) != 3 {
-			log.Printf("invalid condition: %s", rule.Condition)
-			return false
+		set++
+	}
+	if len(rule.And) > 0 {
+		set++
+	}
+	if len(rule.Or) > 0 {
+		set++
+	}
+	switch {
+	case set == 0:
+		errs.add(path, "rule needs a condition, and or or")
+		return
+	case set > 1:
+		errs.add(path, "condition, and and or are mutually exclusive")
+		return
+	}
+
+	if rule.Condition != "" {
+		expr, err := parseExpr(rule.Condition)
+		if err != nil {
+			errs.add(path, "condition %q: %v", rule.Condition, err)
+			return
 		}
+		if _, err := exprUnit(expr); err != nil {
+			errs.add(path, "condition %q: %v", rule.Condition, err)
+			return
+		}
+		rule.expr = expr
+	}
+	for i := range rule.And {
+		compileRule(&rule.And[i], fmt.Sprintf("%s.and[%d]", path, i), errs)
+	}
+	for i := range rule.Or {
+		compileRule(&rule.Or[i], fmt.Sprintf("%s.or[%d]", path, i), errs)
+	}
+}
 
-		key := parts[0]
-		op := parts[1]
-		thresholdStr := parts[2]
+// compileConfig validates and compiles the whole config, reporting every
+// problem rather than stopping at the first.
+func compileConfig(cfg *Config) error {
+	errs := &ConfigError{}
+	names := make(map[string]bool, len(cfg.Alerts))
+
+	for i := range cfg.Alerts {
+		alert := &cfg.Alerts[i]
+		path := fmt.Sprintf("alerts[%d]", i)
+
+		switch {
+		case alert.Name == "":
+			errs.add(path, "name is required")
+		case names[alert.Name]:
+			errs.add(path, "duplicate alert name %q", alert.Name)
+		}
+		names[alert.Name] = true
 
-		threshold, err := parseWithUnits(thresholdStr)
-		if err != nil {
-			log.Printf("error parsing value %s: %v", thresholdStr, err)
-			return false
+		if alert.For < 0 {
+			errs.add(path+".for", "must not be negative")
+		}
+		if alert.Severity != "" && !validSeverity(alert.Severity) {
+			errs.add(path+".severity", "must be one of %s", strings.Join(severityLevels, ", "))
 		}
+		var err error
+		if alert.nameTmpl, err = parseLabelTemplate(alert.Name); err != nil {
+			errs.add(path+".name", "%v", err)
+		}
+		if alert.messageTmpl, err = parseLabelTemplate(alert.Message); err != nil {
+			errs.add(path+".message", "%v", err)
+		}
+		compileRule(&alert.Rule, path+".rule", errs)
+		if !alert.Resolve.empty() {
+			compileRule(&alert.Resolve, path+".resolve", errs)
+		}
+		if !alert.Missing.valid() {
+			errs.add(path+".missing", "must be one of ok, firing, keep, alert")
+		}
+		if f := alert.Flapping; f.Threshold < 0 {
+			errs.add(path+".flapping.threshold", "must not be negative")
+		} else if f.Threshold > 0 && f.Window <= 0 {
+			errs.add(path+".flapping.window", "is required with threshold")
+		}
+	}
 
-		actual, ok := metrics[key]
-		if !ok {
-			log.Printf("missing metric: %s", key)
-			return false
+	cfg.windows = make(map[string]time.Duration)
+	cfg.anomalies = make(map[string]anomalySpec)
+	for i, alert := range cfg.Alerts {
+		windows := make(map[string]time.Duration)
+		alert.Rule.collectWindows(windows)
+		alert.Resolve.collectWindows(windows)
+		names := make([]string, 0, len(windows))
+		for name := range windows {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			w := windows[name]
+			if w > maxHistoryWindow {
+				errs.add(fmt.Sprintf("alerts[%d]", i), "window %s over %s is longer than the %s of history kept", w, name, maxHistoryWindow)
+			}
+			if w > cfg.windows[name] {
+				cfg.windows[name] = w
+			}
 		}
+		alert.Rule.collectAnomalies(cfg.anomalies)
+		alert.Resolve.collectAnomalies(cfg.anomalies)
+	}
 
-		switch op {
-		case ">":
-			return actual > threshold
-		case "<":
-			return actual < threshold
-		case ">=":
-			return actual >= threshold
-		case "<=":
-			return actual <= threshold
-		case "==":
-			return actual == threshold
-		case "!=":
-			return actual != threshold
-		default:
-			log.Printf("unknown operator: %s", op)
-			return false
+	if err := validateSources(cfg.Sources); err != nil {
+		errs.Problems = append(errs.Problems, err.Error())
+	}
+	validateNotifications(cfg, errs)
+	validateSilences(cfg.Silences, errs)
+	validateInhibitRules(cfg.Inhibit, errs)
+	validateAPI(cfg.API, errs)
+	validateAgents(cfg.Agents, errs)
+	validateBaselines(cfg.Baselines, errs)
+	return errs.orNil()
+}
+
+func evalRule(rule Rule, env *evalEnv) bool {
+	active, _ := evalRuleData(rule, env)
+	return active
+}
+
+// evalRuleData evaluates rule and reports separately whether it could not
+// be decided because metrics were missing. A branch that is decided
+// without the missing metrics, such as a false term under and, wins.
+func evalRuleData(rule Rule, env *evalEnv) (active, missing bool) {
+	if rule.Condition != "" {
+		expr := rule.expr
+		if expr == nil {
+			var err error
+			if expr, err = parseExpr(rule.Condition); err != nil {
+				log.Printf("invalid condition %q: %v", rule.Condition, err)
+				return false, false
+			}
+		}
+
+		v, err := expr.Eval(env)
+		if err != nil {
+			// Windowed functions warm up quietly after start or reload.
+			// Missing metrics are left to the alert's missing policy.
+			if _, ok := err.(*missingMetricError); ok {
+				return false, true
+			}
+			if _, ok := err.(*insufficientHistoryError); !ok {
+				log.Printf("%v", err)
+			}
+			return false, false
 		}
+		return v != 0, false
 	}
 
 	if len(rule.And) > 0 {
 		for _, sub := range rule.And {
-			if !evalRule(sub, metrics, ctx) {
-				return false
+			a, m := evalRuleData(sub, env)
+			if !a && !m {
+				return false, false
 			}
+			missing = missing || m
 		}
-		return true
+		return !missing, missing
 	}
 
 	if len(rule.Or) > 0 {
 		for _, sub := range rule.Or {
-			if evalRule(sub, metrics, ctx) {
-				return true
+			a, m := evalRuleData(sub, env)
+			if a {
+				return true, false
 			}
+			missing = missing || m
 		}
-		return false
+		return false, missing
 	}
 
-	return false
+	return false, false
 }
 
 // ---------------- SYSTEM METRICS ----------------
 
+// getSystemMetrics samples the host. Metric names are namespaced with dots:
+//
+//	cpu, cpu.<core>                        cores in use, per-core percent
+//	memory, memory.total, memory.available bytes, memory.used_pct
+//	swap.used, swap.total, swap.used_pct
+//	load1, load5, load15
+//	disk.<mount>.used, .free, .total, .used_pct
+//	net.<iface>.rx_bytes, .tx_bytes, .rx_packets, .tx_packets, .rx_errors, .tx_errors
+//	fd.open, fd.max
+//
+// Per-core, per-disk and per-interface values are also published as labeled
+// series for rules that cover every instance at once:
+//
+//	cpu.core_pct{core="0"}
+//	disk.used{mount="/"}, disk.free, disk.total, disk.used_pct
+//	net.rx_bytes{iface="eth0"}, net.tx_bytes, ... (same set as above)
+//
+// In net.<iface> characters a condition cannot reference become "_", so
+// veth-1a2b is net.veth_1a2b.rx_bytes; the iface label keeps the real name.
+//
+// cpu and memory are required; the rest are best effort and simply missing
+// on platforms where gopsutil cannot provide them.
 func getSystemMetrics() (map[string]float64, error) {
 	metrics := make(map[string]float64)
 
@@ -147,91 +631,261 @@ func getSystemMetrics() (map[string]float64, error) {
 	}
 	metrics["cpu"] = (cpuPercents[0] / 100.0) * float64(cores)
 
+	if perCore, err := cpu.Percent(0, true); err == nil {
+		for i, pct := range perCore {
+			metrics[fmt.Sprintf("cpu.%d", i)] = pct
+			metrics[seriesKey("cpu.core_pct", Labels{"core": strconv.Itoa(i)})] = pct
+		}
+	}
+
 	vm, err := mem.VirtualMemory()
 	if err != nil {
 		return nil, err
 	}
 	metrics["memory"] = float64(vm.Used)
+	metrics["memory.total"] = float64(vm.Total)
+	metrics["memory.available"] = float64(vm.Available)
+	metrics["memory.used_pct"] = vm.UsedPercent
+
+	if sw, err := mem.SwapMemory(); err == nil {
+		metrics["swap.used"] = float64(sw.Used)
+		metrics["swap.total"] = float64(sw.Total)
+		metrics["swap.used_pct"] = sw.UsedPercent
+	}
+
+	if avg, err := load.Avg(); err == nil {
+		metrics["load1"] = avg.Load1
+		metrics["load5"] = avg.Load5
+		metrics["load15"] = avg.Load15
+	}
+
+	collectDiskMetrics(metrics)
+	collectNetMetrics(metrics)
+
+	if open, max, err := openFileDescriptors(); err == nil {
+		metrics["fd.open"] = open
+		metrics["fd.max"] = max
+	}
 
 	return metrics, nil
 }
 
-// ---------------- WEBSOCKET ----------------
+func collectDiskMetrics(metrics map[string]float64) {
+	parts, err := disk.Partitions(false)
+	if err != nil {
+		log.Printf("disk partitions: %v", err)
+		return
+	}
 
-type Client struct {
-	conn *websocket.Conn
-	send chan string
+	for _, p := range parts {
+		usage, err := disk.Usage(p.Mountpoint)
+		if err != nil {
+			continue
+		}
+		values := map[string]float64{
+			"used":     float64(usage.Used),
+			"free":     float64(usage.Free),
+			"total":    float64(usage.Total),
+			"used_pct": usage.UsedPercent,
+		}
+		labels := Labels{"mount": p.Mountpoint}
+		for field, v := range values {
+			metrics["disk."+p.Mountpoint+"."+field] = v
+			metrics[seriesKey("disk."+field, labels)] = v
+		}
+	}
 }
 
-var clients = make(map[*Client]bool)
-var broadcast = make(chan string)
+func collectNetMetrics(metrics map[string]float64) {
+	counters, err := net.IOCounters(true)
+	if err != nil {
+		log.Printf("net counters: %v", err)
+		return
+	}
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
-	conn, _ := upgrader.Upgrade(w, r, nil)
+	for _, c := range counters {
+		values := map[string]float64{
+			"rx_bytes":   float64(c.BytesRecv),
+			"tx_bytes":   float64(c.BytesSent),
+			"rx_packets": float64(c.PacketsRecv),
+			"tx_packets": float64(c.PacketsSent),
+			"rx_errors":  float64(c.Errin),
+			"tx_errors":  float64(c.Errout),
+		}
+		labels := Labels{"iface": c.Name}
+		name := sanitizeMetricSegment(c.Name)
+		for field, v := range values {
+			metrics["net."+name+"."+field] = v
+			metrics[seriesKey("net."+field, labels)] = v
+		}
+	}
+}
+
+// openFileDescriptors reads the system-wide allocated and maximum file
+// handles from /proc/sys/fs/file-nr (Linux only).
+func openFileDescriptors() (float64, float64, error) {
+	data, err := os.ReadFile("/proc/sys/fs/file-nr")
+	if err != nil {
+		return 0, 0, err
+	}
 
-	client := &Client{conn: conn, send: make(chan string, 256)}
-	clients[client] = true
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return 0, 0, fmt.Errorf("unexpected file-nr format: %q", data)
+	}
 
-	go func() {
-		defer conn.Close()
-		for msg := range client.send {
-			conn.WriteMessage(websocket.TextMessage, []byte(msg))
-		}
-	}()
+	open, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return open, max, nil
 }
 
 // ---------------- LOOP ----------------
 
-func startEvaluationLoop(cfg Config) {
-	for {
-		metrics, err := getSystemMetrics()
-		if err != nil {
-			log.Println("Error collecting metrics:", err)
-			continue
+// evaluationInterval is how often the live loop evaluates every rule.
+const evaluationInterval = 5 * time.Second
+
+func startEvaluationLoop(live *LiveConfig, hub *Hub, history *HistoryStore, exporter *Exporter, agents *AgentRegistry) {
+	evaluator := NewEvaluator()
+	if cfg, _ := live.Current(); cfg.Baselines.Snapshot != "" {
+		if err := evaluator.baselines.Load(cfg.Baselines.Snapshot); err != nil {
+			log.Printf("baselines: %v", err)
 		}
+	}
+	var savedAt time.Time
+	held := make(heldAlerts)
 
-		for _, alert := range cfg.Alerts {
-			if evalRule(alert.Rule, metrics, nil) {
-				broadcast <- alert.Name
+	for {
+		cfg, sources := live.Current()
+		metrics := sources.Snapshot()
+		dispatcher := live.Dispatcher()
+		silences := live.Silences()
+		now := time.Now()
+		agents.Collect(metrics, now)
+
+		events := evaluator.Step(cfg, metrics, now)
+		active := evaluator.Active()
+		exporter.Observe(metrics, active, time.Since(now))
+
+		for _, event := range events {
+			event.SilencedBy = silences.SilencedBy(event, now)
+			if event.SilencedBy == "" {
+				event.InhibitedBy = inhibitedBy(cfg.Inhibit, event, active)
+			}
+			if history != nil {
+				history.Record(event)
+			}
+			held.track(event)
+			if event.SilencedBy != "" || event.InhibitedBy != "" {
+				continue
 			}
+			dispatcher.Dispatch(event)
+			hub.Broadcast(event)
 		}
 
-		time.Sleep(5 * time.Second)
-	}
-}
+		// Alerts muted when they fired are sent once their silence ends
+		// or is deleted, or their inhibiting source resolves, if they
+		// still fire and nothing else mutes them.
+		suppressed := func(e AlertEvent) bool {
+			return silences.SilencedBy(e, now) != "" || inhibitedBy(cfg.Inhibit, e, active) != ""
+		}
+		for _, event := range held.release(active, suppressed) {
+			dispatcher.Dispatch(event)
+			hub.Broadcast(event)
+		}
 
-func startBroadcaster() {
-	for {
-		msg := <-broadcast
-		for client := range clients {
-			select {
-			case client.send <- msg:
-			default:
-				delete(clients, client)
+		if path := cfg.Baselines.Snapshot; path != "" && len(cfg.anomalies) > 0 {
+			interval := cfg.Baselines.Interval
+			if interval <= 0 {
+				interval = defaultSnapshotInterval
+			}
+			if now.Sub(savedAt) >= interval {
+				if err := evaluator.baselines.Save(path); err != nil {
+					log.Printf("baselines: %v", err)
+				}
+				savedAt = now
 			}
 		}
+
+		time.Sleep(evaluationInterval)
 	}
 }
 
 // ---------------- MAIN ----------------
 
 func main() {
-	var cfg Config
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backtest":
+			if err := runBacktest(os.Args[2:]); err != nil {
+				log.Fatalf("Backtest failed: %v", err)
+			}
+			return
+		case "agent":
+			if err := runAgent(os.Args[2:]); err != nil {
+				log.Fatalf("Agent failed: %v", err)
+			}
+			return
+		}
+	}
 
 	v := viper.New()
 	v.SetConfigFile("rules.yaml")
 	if err := v.ReadInConfig(); err != nil {
 		log.Fatalf("Failed to read config: %v", err)
 	}
-	if err := v.Unmarshal(&cfg); err != nil {
+	cfg, err := loadConfig(v)
+	if err != nil {
 		log.Fatalf("Failed to parse config: %v", err)
 	}
+	live, err := NewLiveConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid rules: %v", err)
+	}
+	watchConfig(v, live)
+
+	// The history and key databases are opened once; changing them needs a
+	// restart.
+	var keys *KeyStore
+	if cfg.API.Keys.Driver != "" {
+		if keys, err = OpenKeyStore(cfg.API.Keys); err != nil {
+			log.Fatalf("Failed to open key store: %v", err)
+		}
+	}
+	auth := NewAuthenticator(live, keys)
 
-	go startBroadcaster()
-	go startEvaluationLoop(cfg)
+	var history *HistoryStore
+	if cfg.History.Driver != "" {
+		if history, err = OpenHistory(cfg.History); err != nil {
+			log.Fatalf("Failed to open history: %v", err)
+		}
+		http.Handle("/api/alerts/history", auth.Require("history", history))
+	}
 
-	http.HandleFunc("/ws", handleConnections)
+	hub := NewHub(auth.CheckOrigin)
+	go hub.Run()
+	exporter := NewExporter(hub)
+	agents := NewAgentRegistry(live)
+	go startEvaluationLoop(live, hub, history, exporter, agents)
+
+	http.Handle("/push/", auth.Require("push", pushHandler(live.Sources)))
+	silences := auth.Require("silences", live.Silences())
+	http.Handle("/api/silences", silences)
+	http.Handle("/api/silences/", silences)
+	rules := auth.Require("rules", NewRulesAPI(live, v.ConfigFileUsed()))
+	http.Handle("/api/rules", rules)
+	http.Handle("/api/rules/", rules)
+	http.Handle("/ws", auth.Require("alerts", http.HandlerFunc(hub.ServeWS)))
+	http.Handle(alertStreamPath, auth.Require("alerts", http.HandlerFunc(hub.ServeSSE)))
+	http.Handle("/api/alerts/poll", auth.Require("alerts", http.HandlerFunc(hub.ServePoll)))
+	http.Handle("/metrics", auth.Require("metrics", exporter))
+	http.Handle("/api/agents", auth.Require("agents", agents))
+	http.Handle("/api/agents/", auth.Require("agents", agents))
 	log.Println("WebSocket server on :8080/ws")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ---------------- AGENTS ----------------
+//
+// In agent mode (alerts agent -config agent.yaml) the binary only collects
+// its sources and pushes them to a central server, which evaluates the
+// rules for every host. Each pushed series gains a host label, so
+// cpu > 90 fires once per host and absent(cpu) fires for a host that
+// stopped reporting. A host's instances never fall back to the server's
+// own unlabeled series: a metric the host did not push is missing.
+
+// AgentsConfig is the server side:
+//
+//	agents:
+//	  token: s3cret            # shared secret; JWTs granting "agents" work too
+//	  stale_after: 1m          # drop a host's series after this long without a push
+//	  expected: [web1, web2]   # known hosts, reported down until their first push
+//
+// A push names its host in the body, so the credential decides which hosts
+// it may speak for: a JWT granting agents{host="web1"} only web1, any other
+// credential only the expected hosts, or any host when none are listed.
+//
+// Besides the pushed series the server publishes agent.up{host} (1 or 0)
+// and agent.last_seen_seconds{host} for every host it has heard from.
+type AgentsConfig struct {
+	Token      string        `mapstructure:"token"`
+	StaleAfter time.Duration `mapstructure:"stale_after"`
+	Expected   []string      `mapstructure:"expected"`
+}
+
+// AgentConfig is the agent side:
+//
+//	agent:
+//	  server: http://alerts.internal:8080
+//	  host: web1               # defaults to the hostname
+//	  token: s3cret
+//	  interval: 15s
+type AgentConfig struct {
+	Server   string        `mapstructure:"server"`
+	Host     string        `mapstructure:"host"`
+	Token    string        `mapstructure:"token"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+const (
+	defaultAgentInterval = 15 * time.Second
+	defaultStaleAfter    = time.Minute
+	maxAgentPushSize     = 4 << 20
+)
+
+// AgentPush is the body of POST /api/agents/push.
+type AgentPush struct {
+	Host    string             `json:"host"`
+	Time    time.Time          `json:"time"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+func validateAgents(cfg AgentsConfig, errs *ConfigError) {
+	if cfg.StaleAfter < 0 {
+		errs.add("agents.stale_after", "must not be negative")
+	}
+	for i, host := range cfg.Expected {
+		if host == "" {
+			errs.add(fmt.Sprintf("agents.expected[%d]", i), "host must not be empty")
+		}
+	}
+}
+
+// ---------------- AGENT REGISTRY ----------------
+
+type agentState struct {
+	metrics  map[string]float64 // series keys already carrying host
+	lastSeen time.Time
+}
+
+// AgentRegistry keeps the latest push from every agent.
+type AgentRegistry struct {
+	mu    sync.Mutex
+	live  *LiveConfig
+	hosts map[string]*agentState
+}
+
+func NewAgentRegistry(live *LiveConfig) *AgentRegistry {
+	return &AgentRegistry{live: live, hosts: make(map[string]*agentState)}
+}
+
+// Push replaces the samples of p.Host. The server's clock decides
+// freshness, so agents with a skewed clock are not marked stale.
+func (a *AgentRegistry) Push(p AgentPush, now time.Time) error {
+	if p.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+
+	metrics := make(map[string]float64, len(p.Metrics))
+	for key, v := range p.Metrics {
+		name, labels, err := parseSeriesKey(key)
+		if err != nil {
+			return err
+		}
+		metrics[seriesKey(name, labels.Merge(Labels{"host": p.Host}))] = v
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hosts[p.Host] = &agentState{metrics: metrics, lastSeen: now}
+	return nil
+}
+
+// Collect adds the series of every fresh agent to metrics, along with
+// agent.up and agent.last_seen_seconds for every known host.
+func (a *AgentRegistry) Collect(metrics map[string]float64, now time.Time) {
+	cfg, _ := a.live.Current()
+	staleAfter := cfg.Agents.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = defaultStaleAfter
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, host := range cfg.Agents.Expected {
+		if _, ok := a.hosts[host]; !ok {
+			metrics[seriesKey("agent.up", Labels{"host": host})] = 0
+		}
+	}
+	for host, st := range a.hosts {
+		labels := Labels{"host": host}
+		age := now.Sub(st.lastSeen)
+		metrics[seriesKey("agent.last_seen_seconds", labels)] = age.Seconds()
+		if age > staleAfter {
+			metrics[seriesKey("agent.up", labels)] = 0
+			continue
+		}
+		metrics[seriesKey("agent.up", labels)] = 1
+		for k, v := range st.metrics {
+			metrics[k] = v
+		}
+	}
+}
+
+// authorize checks that acc may push the samples of host.
+func (a *AgentRegistry) authorize(acc *Access, host string) error {
+	scopes, err := acc.agentHosts()
+	if err != nil {
+		return err
+	}
+	if scopes != nil {
+		labels := Labels{"host": host}
+	scope:
+		for _, matchers := range scopes {
+			for _, m := range matchers {
+				if !m.matches(labels) {
+					continue scope
+				}
+			}
+			return nil
+		}
+		return fmt.Errorf("token may not push for host %q", host)
+	}
+
+	cfg, _ := a.live.Current()
+	if len(cfg.Agents.Expected) == 0 {
+		return nil
+	}
+	for _, h := range cfg.Agents.Expected {
+		if h == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q is not in agents.expected", host)
+}
+
+type agentInfo struct {
+	Host     string    `json:"host"`
+	LastSeen time.Time `json:"last_seen"`
+	Series   int       `json:"series"`
+}
+
+// ServeHTTP handles
+//
+//	POST /api/agents/push   store an AgentPush
+//	GET  /api/agents        list hosts and when they last pushed
+func (a *AgentRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	switch {
+	case path == "/api/agents/push" && r.Method == http.MethodPost:
+		var p AgentPush
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAgentPushSize)).Decode(&p); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if p.Host != "" {
+			if err := a.authorize(accessFrom(r.Context()), p.Host); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		if err := a.Push(p, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case path == "/api/agents" && r.Method == http.MethodGet:
+		a.mu.Lock()
+		infos := make([]agentInfo, 0, len(a.hosts))
+		for host, st := range a.hosts {
+			infos = append(infos, agentInfo{Host: host, LastSeen: st.lastSeen, Series: len(st.metrics)})
+		}
+		a.mu.Unlock()
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Host < infos[j].Host })
+		writeJSON(w, http.StatusOK, infos)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ---------------- AGENT MODE ----------------
+
+// finiteMetrics drops the values a push cannot carry: one NaN would make
+// the whole JSON body fail to encode.
+func finiteMetrics(metrics map[string]float64) map[string]float64 {
+	out := make(map[string]float64, len(metrics))
+	for k, v := range metrics {
+		if finite(v) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func runAgent(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	path := fs.String("config", "agent.yaml", "agent config file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(*path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(v)
+	if err != nil {
+		return err
+	}
+
+	ac := cfg.Agent
+	if ac.Server == "" {
+		return fmt.Errorf("agent.server is required")
+	}
+	if ac.Host == "" {
+		if ac.Host, err = os.Hostname(); err != nil {
+			return fmt.Errorf("agent.host: %v", err)
+		}
+	}
+	if ac.Interval <= 0 {
+		ac.Interval = defaultAgentInterval
+	}
+
+	sources, err := NewSourceSet(cfg.Sources)
+	if err != nil {
+		return err
+	}
+	defer sources.Stop()
+
+	url := strings.TrimSuffix(ac.Server, "/") + "/api/agents/push"
+	headers := map[string]string{}
+	if ac.Token != "" {
+		headers["Authorization"] = "Bearer " + ac.Token
+	}
+	log.Printf("agent %s pushing to %s every %s", ac.Host, url, ac.Interval)
+
+	ticker := time.NewTicker(ac.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		metrics := sources.Snapshot()
+		if len(metrics) == 0 {
+			continue
+		}
+		p := AgentPush{Host: ac.Host, Time: time.Now(), Metrics: finiteMetrics(metrics)}
+		if err := postJSON(context.Background(), url, headers, ac.Interval, p); err != nil {
+			log.Printf("agent: push failed: %v", err)
+		}
+	}
+	return nil
+}
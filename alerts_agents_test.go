@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentPushAndAbsent(t *testing.T) {
+	live, err := NewLiveConfig(Config{Agents: AgentsConfig{StaleAfter: time.Minute, Expected: []string{"web1", "web2", "web3"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(live.Sources().Stop)
+	agents := NewAgentRegistry(live)
+
+	push := func(body string) int {
+		rec := httptest.NewRecorder()
+		agents.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/agents/push", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := push(`{"host":"web1","metrics":{"cpu":95,"disk.used_pct{mount=\"/\"}":50}}`); code != http.StatusNoContent {
+		t.Fatalf("push web1: status %d", code)
+	}
+	if code := push(`{"host":"web2","metrics":{"cpu":10}}`); code != http.StatusNoContent {
+		t.Fatalf("push web2: status %d", code)
+	}
+	for _, body := range []string{`{"metrics":{"cpu":1}}`, `{"host":"web1","metrics":{"cpu{":1}}`, `{`} {
+		if code := push(body); code != http.StatusBadRequest {
+			t.Errorf("push %s: status %d, want 400", body, code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	agents.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/agents", nil))
+	var infos []agentInfo
+	json.Unmarshal(rec.Body.Bytes(), &infos)
+	if len(infos) != 2 || infos[0].Host != "web1" || infos[0].Series != 2 || infos[1].Host != "web2" {
+		t.Errorf("agents = %+v", infos)
+	}
+
+	cfg := Config{Alerts: []Alert{
+		{Name: "cpu_high", Rule: Rule{Condition: "cpu > 90"}},
+		{Name: "cpu_absent", Rule: Rule{Condition: "absent(cpu)"}},
+		{Name: "agent_down", Rule: Rule{Condition: "agent.up == 0"}},
+	}}
+	if err := compileConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEvaluator()
+	step := func(now time.Time) map[string]AlertState {
+		metrics := make(map[string]float64)
+		agents.Collect(metrics, now)
+		got := make(map[string]AlertState)
+		for _, e := range ev.Step(cfg, metrics, now) {
+			got[e.Alert+"/"+e.Labels["host"]] = e.State
+		}
+		return got
+	}
+	expect := func(when string, got, want map[string]AlertState) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s: events %v, want %v", when, got, want)
+			return
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s: events %v, want %v", when, got, want)
+				return
+			}
+		}
+	}
+
+	now := time.Now()
+	expect("first tick", step(now), map[string]AlertState{
+		"cpu_high/web1":   StateFiring,
+		"agent_down/web3": StateFiring,
+	})
+
+	// web2 keeps pushing, web1 goes quiet and turns stale.
+	if err := agents.Push(AgentPush{Host: "web2", Metrics: map[string]float64{"cpu": 12}}, now.Add(90*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	expect("web1 stale", step(now.Add(2*time.Minute)), map[string]AlertState{
+		"cpu_high/web1":   StateResolved,
+		"cpu_absent/web1": StateFiring,
+		"agent_down/web1": StateFiring,
+	})
+}
+
+func TestFiniteMetrics(t *testing.T) {
+	metrics := map[string]float64{"cpu": 3, "cpu.iowait": math.NaN(), "net.rx_rate": math.Inf(1), "load1": math.Inf(-1)}
+	got := finiteMetrics(metrics)
+	if len(got) != 1 || got["cpu"] != 3 {
+		t.Errorf("finiteMetrics = %v, want only cpu", got)
+	}
+	if _, err := json.Marshal(AgentPush{Host: "web1", Metrics: got}); err != nil {
+		t.Errorf("marshal push: %v", err)
+	}
+}
+
+func TestAgentPushHostBinding(t *testing.T) {
+	live, err := NewLiveConfig(Config{Agents: AgentsConfig{Expected: []string{"web1", "web2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(live.Sources().Stop)
+	agents := NewAgentRegistry(live)
+
+	tests := []struct {
+		resources []string
+		host      string
+		want      int
+	}{
+		{nil, "web1", http.StatusNoContent},
+		{nil, "web9", http.StatusForbidden},
+		{[]string{"agents"}, "web2", http.StatusNoContent},
+		{[]string{"agents"}, "web9", http.StatusForbidden},
+		{[]string{`agents{host="web2"}`}, "web2", http.StatusNoContent},
+		{[]string{`agents{host="web2"}`}, "web1", http.StatusForbidden},
+		{[]string{`agents{host=~"db.*"}`, `agents{host="web1"}`}, "db3", http.StatusNoContent},
+		{[]string{`agents{host=~"db.*"}`}, "web1", http.StatusForbidden},
+		{[]string{`agents{host=~"("}`}, "web1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/agents/push", strings.NewReader(`{"host":"`+tt.host+`","metrics":{"cpu":1}}`))
+		req = req.WithContext(context.WithValue(req.Context(), accessKey{}, &Access{Resources: tt.resources}))
+		rec := httptest.NewRecorder()
+		agents.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%v pushing %s: status %d, want %d", tt.resources, tt.host, rec.Code, tt.want)
+		}
+	}
+
+	// Without expected hosts a shared credential may push for any host.
+	if err := live.Apply(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agents.authorize(&Access{Resources: []string{"agents"}}, "web9"); err != nil {
+		t.Errorf("authorize without expected hosts: %v", err)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- ANOMALY DETECTION ----------------
+//
+// Anomaly functions score how far a series is from its own learnt
+// baseline, in standard deviations, positive above and negative below:
+//
+//	zscore(cpu, 1h) > 3                    baseline decays over about 1h
+//	ewma_deviation(net.rx_bytes, 0.1) > 2  every sample moves it by 10%
+//	seasonal_zscore(net.rx_bytes, 7d) > 3  same hour of the previous 7 days
+//
+// Every sample is scored against the baseline as it stood before the
+// sample, then folded in. Baselines are kept per series by the evaluator
+// and can be saved to a snapshot so they survive restarts:
+//
+//	baselines:
+//	  snapshot: baselines.json
+//	  interval: 1m              # how often to save it
+//
+// Until a baseline has seen enough data (one window for zscore, 1/alpha
+// samples for ewma_deviation, two previous days for seasonal_zscore) the
+// function reports insufficient history, which keeps the rule quiet. A
+// series that has never varied scores 0. NaN and infinite samples are
+// ignored.
+
+type BaselineConfig struct {
+	Snapshot string        `mapstructure:"snapshot"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+const (
+	minBaselineSamples      = 10
+	defaultSnapshotInterval = time.Minute
+	baselineRetention       = 7 * 24 * time.Hour // forget series unseen this long
+	baselineSnapshotVersion = 1
+)
+
+func validateBaselines(cfg BaselineConfig, errs *ConfigError) {
+	if cfg.Interval < 0 {
+		errs.add("baselines.interval", "must not be negative")
+	}
+}
+
+// anomalySpec is one anomaly function applied to a metric, e.g.
+// zscore(cpu, 1h). Every series of the metric gets its own baseline.
+type anomalySpec struct {
+	fn     string
+	metric string
+	param  float64 // window in seconds, alpha, or days
+}
+
+func (s anomalySpec) id() string {
+	return fmt.Sprintf("%s(%s, %g)", s.fn, s.metric, s.param)
+}
+
+// retention is how long the baseline of a series that stopped reporting
+// is kept.
+func (s anomalySpec) retention() time.Duration {
+	if s.fn == "seasonal_zscore" {
+		if d := time.Duration(s.param) * 24 * time.Hour; d > baselineRetention {
+			return d
+		}
+	}
+	return baselineRetention
+}
+
+// ---------------- BASELINES ----------------
+
+// baseline is the learnt behaviour of one series under one anomalySpec.
+type baseline struct {
+	Mean  float64   `json:"mean"`
+	Var   float64   `json:"var"`
+	N     int       `json:"n"`
+	Start time.Time `json:"start"`
+	Seen  time.Time `json:"seen"`
+	Score float64   `json:"score"`
+	Ready bool      `json:"ready"`
+
+	// seasonal_zscore only
+	Hours     [][]hourStats `json:"hours,omitempty"` // per hour of day, the previous days, oldest first
+	HourStart time.Time     `json:"hour_start"`
+	HourSum   float64       `json:"hour_sum,omitempty"`
+	HourSumSq float64       `json:"hour_sum_sq,omitempty"`
+	HourCount int           `json:"hour_count,omitempty"`
+}
+
+// hourStats summarises one clock hour of one day.
+type hourStats struct {
+	Mean float64 `json:"mean"`
+	Var  float64 `json:"var"`
+}
+
+func (b *baseline) observe(spec anomalySpec, v float64, now time.Time) {
+	if spec.fn == "seasonal_zscore" {
+		b.observeSeasonal(int(spec.param), v, now)
+		b.Seen = now
+		return
+	}
+
+	if b.N == 0 {
+		b.Mean, b.Var, b.N, b.Start, b.Seen = v, 0, 1, now, now
+		return
+	}
+
+	alpha := spec.param
+	if spec.fn == "zscore" {
+		// Decay by elapsed time so the window holds at any tick rate.
+		alpha = 1 - math.Exp(-now.Sub(b.Seen).Seconds()/spec.param)
+		b.Ready = b.N >= minBaselineSamples && now.Sub(b.Start).Seconds() >= spec.param
+	} else {
+		b.Ready = b.N >= minBaselineSamples && float64(b.N) >= 1/alpha
+	}
+	b.Score = deviation(v, b.Mean, b.Var)
+
+	diff := v - b.Mean
+	incr := alpha * diff
+	b.Mean += incr
+	b.Var = (1 - alpha) * (b.Var + diff*incr)
+	b.N++
+	b.Seen = now
+}
+
+// observeSeasonal accumulates the samples of the current clock hour and,
+// once the hour is over, appends their mean and variance to that hour's
+// previous days. A sample is scored against the pooled samples of its hour
+// on those days: the spread within each hour plus the spread between days.
+func (b *baseline) observeSeasonal(days int, v float64, now time.Time) {
+	if len(b.Hours) != 24 {
+		b.Hours = make([][]hourStats, 24)
+	}
+	hour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	if !hour.Equal(b.HourStart) {
+		if b.HourCount > 0 {
+			n := float64(b.HourCount)
+			mean := b.HourSum / n
+			h := b.HourStart.Hour()
+			b.Hours[h] = append(b.Hours[h], hourStats{Mean: mean, Var: math.Max(b.HourSumSq/n-mean*mean, 0)})
+			if n := len(b.Hours[h]); n > days {
+				b.Hours[h] = b.Hours[h][n-days:]
+			}
+		}
+		b.HourStart, b.HourSum, b.HourSumSq, b.HourCount = hour, 0, 0, 0
+	}
+
+	prev := b.Hours[now.Hour()]
+	b.Ready = len(prev) >= 2
+	if b.Ready {
+		var mean, variance float64
+		for _, d := range prev {
+			mean += d.Mean
+		}
+		mean /= float64(len(prev))
+		for _, d := range prev {
+			variance += d.Var + (d.Mean-mean)*(d.Mean-mean)
+		}
+		b.Score = deviation(v, mean, variance/float64(len(prev)))
+	}
+	b.HourSum += v
+	b.HourSumSq += v * v
+	b.HourCount++
+	b.N++
+}
+
+func deviation(v, mean, variance float64) float64 {
+	if variance <= 0 {
+		return 0
+	}
+	return (v - mean) / math.Sqrt(variance)
+}
+
+// Baselines holds the baselines of every configured anomaly function.
+type Baselines struct {
+	mu    sync.Mutex
+	specs map[string]map[string]*baseline // spec id -> series key -> baseline
+}
+
+func NewBaselines() *Baselines {
+	return &Baselines{specs: make(map[string]map[string]*baseline)}
+}
+
+// Record scores and folds in the current value of every series an
+// anomaly function in specs refers to, and forgets baselines that are no
+// longer configured or whose series have been gone for too long.
+func (b *Baselines) Record(specs map[string]anomalySpec, idx seriesIndex, metrics map[string]float64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, spec := range specs {
+		series, ok := b.specs[id]
+		if !ok {
+			series = make(map[string]*baseline)
+			b.specs[id] = series
+		}
+		for _, s := range idx[spec.metric] {
+			bl, ok := series[s.key]
+			v := metrics[s.key]
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				// One such sample would poison the mean for good. Nor is
+				// there a score for it; the next finite sample restores
+				// readiness.
+				if ok {
+					bl.Ready = false
+				}
+				continue
+			}
+			if !ok {
+				bl = &baseline{}
+				series[s.key] = bl
+			}
+			bl.observe(spec, v, now)
+		}
+		for key, bl := range series {
+			if now.Sub(bl.Seen) > spec.retention() {
+				delete(series, key)
+			}
+		}
+	}
+
+	for id := range b.specs {
+		if _, ok := specs[id]; !ok {
+			delete(b.specs, id)
+		}
+	}
+}
+
+// Score returns the latest score of series key under spec, or false while
+// its baseline is still warming up.
+func (b *Baselines) Score(spec anomalySpec, key string) (float64, bool) {
+	if b == nil {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bl, ok := b.specs[spec.id()][key]
+	if !ok || !bl.Ready {
+		return 0, false
+	}
+	return bl.Score, true
+}
+
+type baselineSnapshot struct {
+	Version   int                             `json:"version"`
+	Saved     time.Time                       `json:"saved"`
+	Baselines map[string]map[string]*baseline `json:"baselines"`
+}
+
+// Save writes every baseline to path.
+func (b *Baselines) Save(path string) error {
+	b.mu.Lock()
+	data, err := json.Marshal(baselineSnapshot{Version: baselineSnapshotVersion, Saved: time.Now(), Baselines: b.specs})
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Load replaces the baselines with the snapshot at path. A missing file is
+// not an error: there is simply nothing learnt yet.
+func (b *Baselines) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap baselineSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if snap.Version != baselineSnapshotVersion {
+		return fmt.Errorf("%s: unsupported snapshot version %d", path, snap.Version)
+	}
+	if snap.Baselines == nil {
+		snap.Baselines = make(map[string]map[string]*baseline)
+	}
+
+	b.mu.Lock()
+	b.specs = snap.Baselines
+	b.mu.Unlock()
+	return nil
+}
+
+// ---------------- ANOMALY FUNCTIONS ----------------
+
+// anomalyExpr is an anomaly function over one series.
+type anomalyExpr struct {
+	spec  anomalySpec
+	sel   *metricExpr
+	param string // as written
+}
+
+func (a *anomalyExpr) Eval(env *evalEnv) (float64, error) {
+	key, ok := env.resolve(a.sel)
+	if !ok {
+		return 0, &missingMetricError{name: seriesKey(a.sel.String(), env.instance)}
+	}
+	score, ok := env.baselines.Score(a.spec, key)
+	if !ok {
+		return 0, &insufficientHistoryError{expr: a.String()}
+	}
+	return score, nil
+}
+
+func (a *anomalyExpr) String() string {
+	return a.spec.fn + "(" + a.sel.String() + ", " + a.param + ")"
+}
+
+var anomalyFuncs = map[string]string{
+	"zscore":          "a window, e.g. zscore(cpu, 1h)",
+	"ewma_deviation":  "a smoothing factor between 0 and 1, e.g. ewma_deviation(net.rx_bytes, 0.1)",
+	"seasonal_zscore": "a number of days of at least 2d, e.g. seasonal_zscore(net.rx_bytes, 7d)",
+}
+
+func (p *parser) parseAnomaly(name token) (Expr, error) {
+	fn := strings.ToLower(name.text)
+	usage := anomalyFuncs[fn]
+	p.next() // (
+
+	m := p.next()
+	if m.kind != tokIdent {
+		return nil, fmt.Errorf("at %d: %s expects a metric and %s", m.pos, name.text, usage)
+	}
+	if c := p.next(); c.kind != tokComma {
+		return nil, fmt.Errorf("at %d: %s expects a metric and %s", c.pos, name.text, usage)
+	}
+	arg := p.next()
+	if arg.kind != tokNumber {
+		return nil, fmt.Errorf("at %d: %s expects %s", arg.pos, name.text, usage)
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return nil, fmt.Errorf("at %d: expected ')' after arguments to %s", c.pos, name.text)
+	}
+
+	param := arg.num
+	switch fn {
+	case "zscore":
+		if arg.unit != unitSeconds || param <= 0 {
+			return nil, fmt.Errorf("at %d: %s expects %s", arg.pos, name.text, usage)
+		}
+	case "ewma_deviation":
+		if arg.unit != unitAny || param <= 0 || param > 1 {
+			return nil, fmt.Errorf("at %d: %s expects %s", arg.pos, name.text, usage)
+		}
+	case "seasonal_zscore":
+		param = math.Round(param / 86400)
+		if arg.unit != unitSeconds || param < 2 {
+			return nil, fmt.Errorf("at %d: %s expects %s", arg.pos, name.text, usage)
+		}
+	}
+
+	return &anomalyExpr{
+		spec:  anomalySpec{fn: fn, metric: m.text, param: param},
+		sel:   &metricExpr{name: m.text, matchers: m.matchers},
+		param: arg.text,
+	}, nil
+}
+
+// exprAnomalies records every anomaly function in e by spec id.
+func exprAnomalies(e Expr, out map[string]anomalySpec) {
+	switch n := e.(type) {
+	case *anomalyExpr:
+		out[n.spec.id()] = n.spec
+	case *unaryExpr:
+		exprAnomalies(n.x, out)
+	case *binaryExpr:
+		exprAnomalies(n.l, out)
+		exprAnomalies(n.r, out)
+	case *callExpr:
+		for _, a := range n.args {
+			exprAnomalies(a, out)
+		}
+	case *rangeCallExpr:
+		for _, a := range n.args {
+			exprAnomalies(a, out)
+		}
+	}
+}
+
+func (r Rule) collectAnomalies(out map[string]anomalySpec) {
+	if r.expr != nil {
+		exprAnomalies(r.expr, out)
+	}
+	for _, sub := range r.And {
+		sub.collectAnomalies(out)
+	}
+	for _, sub := range r.Or {
+		sub.collectAnomalies(out)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBaselinesSkipNonFinite(t *testing.T) {
+	spec := anomalySpec{fn: "ewma_deviation", metric: "cpu", param: 0.1}
+	specs := map[string]anomalySpec{spec.id(): spec}
+	b := NewBaselines()
+	start := time.Unix(1700000000, 0)
+
+	record := func(i int, v float64) {
+		metrics := map[string]float64{"cpu": v}
+		b.Record(specs, buildSeriesIndex(metrics), metrics, start.Add(time.Duration(i)*time.Minute))
+	}
+	for i := 0; i < 20; i++ {
+		record(i, float64(10+i%3))
+	}
+	if _, ok := b.Score(spec, "cpu"); !ok {
+		t.Fatal("baseline not ready after 20 samples")
+	}
+
+	record(20, math.NaN())
+	if _, ok := b.Score(spec, "cpu"); ok {
+		t.Error("NaN sample scored")
+	}
+	record(21, math.Inf(1))
+	record(22, 11)
+	score, ok := b.Score(spec, "cpu")
+	if !ok || math.IsNaN(score) || math.IsInf(score, 0) {
+		t.Errorf("score after non-finite samples = %v, %v", score, ok)
+	}
+
+	path := filepath.Join(t.TempDir(), "baselines.json")
+	if err := b.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded := NewBaselines()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got, ok := loaded.Score(spec, "cpu"); !ok || got != score {
+		t.Errorf("loaded score = %v, %v, want %v", got, ok, score)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// ---------------- API AUTH ----------------
+
+// APIConfig guards the alert HTTP APIs and the WebSocket stream. Requests
+// carry either the static token or a JWT issued by GenerateJWT:
+//
+//	api:
+//	  token: s3cret                    # full access
+//	  jwt_secret: your-secret-key      # HS256 key the tokens are signed with
+//	  keys:                            # where GenerateJWT stores issued keys
+//	    driver: postgres
+//	    dsn: host=db user=auth dbname=auth
+//	  allowed_origins: [https://dash.example.com]
+//
+// A JWT reaches the resources named in its allowed_resources claim: rules,
+// silences, history, metrics, agents, push (POSTs to /push/<name>) and
+// alerts (the live alert streams).
+// An alerts resource may carry a label selector, so alerts{team="db"} only
+// streams the db team's alerts and alerts{alertname="disk_full"} a single
+// alert.
+// An agents resource may select hosts the same way: agents{host="web1"}
+// may only push web1's samples.
+type APIConfig struct {
+	Token          string         `mapstructure:"token"`
+	JWTSecret      string         `mapstructure:"jwt_secret"`
+	Keys           KeyStoreConfig `mapstructure:"keys"`
+	AllowedOrigins []string       `mapstructure:"allowed_origins"`
+}
+
+type KeyStoreConfig struct {
+	Driver string `mapstructure:"driver"`
+	DSN    string `mapstructure:"dsn"`
+}
+
+func validateAPI(cfg APIConfig, errs *ConfigError) {
+	if cfg.JWTSecret != "" && cfg.Keys.Driver == "" {
+		errs.add("api.keys.driver", "is required with jwt_secret to check for revoked tokens")
+	}
+	for i, origin := range cfg.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			errs.add(fmt.Sprintf("api.allowed_origins[%d]", i), "invalid origin %q", origin)
+		}
+	}
+}
+
+// ---------------- ISSUED KEYS ----------------
+
+// issuedKey is the row GenerateJWT stores for every token it issues.
+type issuedKey struct {
+	ID        uint
+	UserID    uint
+	JWTID     string `gorm:"column:jwt_id"`
+	RevokedAt *time.Time
+}
+
+func (issuedKey) TableName() string {
+	return "api_keys"
+}
+
+// KeyStore reads the issuer's api_keys table to reject unknown and revoked
+// tokens. The table belongs to the issuer and is never written here.
+type KeyStore struct {
+	db *gorm.DB
+}
+
+func OpenKeyStore(cfg KeyStoreConfig) (*KeyStore, error) {
+	db, err := openDatabase(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{db: db}, nil
+}
+
+// Valid reports whether the token with ID jti was issued and has not been
+// revoked, and returns the user it belongs to.
+func (k *KeyStore) Valid(jti string) (bool, uint) {
+	var key issuedKey
+	if err := k.db.Where("jwt_id = ?", jti).First(&key).Error; err != nil {
+		return false, 0
+	}
+	if key.RevokedAt != nil {
+		return false, 0
+	}
+	return true, key.UserID
+}
+
+// ---------------- ACCESS ----------------
+
+// Access is what an authenticated request may reach.
+type Access struct {
+	UserID    uint
+	Resources []string  // nil for the static token, which reaches everything
+	Expires   time.Time // zero for the static token
+}
+
+func (a *Access) allows(resource string) bool {
+	if a.Resources == nil {
+		return true
+	}
+	for _, r := range a.Resources {
+		if r == resource || strings.HasPrefix(r, resource+"{") {
+			return true
+		}
+	}
+	return false
+}
+
+// alertGrant limits which alerts a client may receive. An empty grant
+// allows every alert.
+type alertGrant []labelMatcher
+
+func (g alertGrant) matches(e AlertEvent) bool {
+	for _, m := range g {
+		if !m.matches(e.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// granted reports whether any of grants allows e.
+func granted(grants []alertGrant, e AlertEvent) bool {
+	for _, g := range grants {
+		if g.matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// alertGrants returns one grant per alerts resource of a.
+func (a *Access) alertGrants() ([]alertGrant, error) {
+	if a.Resources == nil {
+		return []alertGrant{nil}, nil
+	}
+	var out []alertGrant
+	for _, r := range a.Resources {
+		switch {
+		case r == "alerts":
+			out = append(out, nil)
+		case strings.HasPrefix(r, "alerts{") && strings.HasSuffix(r, "}"):
+			matchers, err := parseMatchers(r[len("alerts{") : len(r)-1])
+			if err != nil {
+				return nil, fmt.Errorf("resource %s: %v", r, err)
+			}
+			out = append(out, alertGrant(matchers))
+		}
+	}
+	return out, nil
+}
+
+// agentHosts returns the host selector of every agents{...} resource of a.
+// A nil result, for the static tokens and a plain agents resource, leaves
+// the pushing host unbound.
+func (a *Access) agentHosts() ([][]labelMatcher, error) {
+	if a == nil || a.Resources == nil {
+		return nil, nil
+	}
+	var out [][]labelMatcher
+	for _, r := range a.Resources {
+		switch {
+		case r == "agents":
+			return nil, nil
+		case strings.HasPrefix(r, "agents{") && strings.HasSuffix(r, "}"):
+			matchers, err := parseMatchers(r[len("agents{") : len(r)-1])
+			if err != nil {
+				return nil, fmt.Errorf("resource %s: %v", r, err)
+			}
+			out = append(out, matchers)
+		}
+	}
+	return out, nil
+}
+
+type accessKey struct{}
+
+// accessFrom returns the Access that Require attached to ctx, or nil.
+func accessFrom(ctx context.Context) *Access {
+	acc, _ := ctx.Value(accessKey{}).(*Access)
+	return acc
+}
+
+// ---------------- AUTHENTICATOR ----------------
+
+// Authenticator checks bearer tokens against the live API config.
+type Authenticator struct {
+	live *LiveConfig
+	keys *KeyStore // nil when no key store is configured
+}
+
+func NewAuthenticator(live *LiveConfig, keys *KeyStore) *Authenticator {
+	return &Authenticator{live: live, keys: keys}
+}
+
+// Require rejects requests without a token that reaches resource. With
+// neither a static token nor a JWT secret configured every request is
+// rejected, except that agents may also use the agents.token secret.
+func (a *Authenticator) Require(resource string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acc, ok := a.authenticate(w, r, resource)
+		if !ok {
+			return
+		}
+		if !acc.allows(resource) {
+			http.Error(w, "Access Denied", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), accessKey{}, acc)))
+	})
+}
+
+// authenticate validates the request's token the way verifyTokenHandler
+// does: signature, expiry, and a jti that was issued and not revoked.
+func (a *Authenticator) authenticate(w http.ResponseWriter, r *http.Request, resource string) (*Access, bool) {
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	cfg, _ := a.live.Current()
+	if cfg.API.Token != "" && subtle.ConstantTimeCompare([]byte(tokenString), []byte(cfg.API.Token)) == 1 {
+		return &Access{}, true
+	}
+	if resource == "agents" && cfg.Agents.Token != "" && subtle.ConstantTimeCompare([]byte(tokenString), []byte(cfg.Agents.Token)) == 1 {
+		return &Access{Resources: []string{"agents"}}, true
+	}
+	if cfg.API.JWTSecret == "" {
+		http.Error(w, "Invalid token", http.StatusForbidden)
+		return nil, false
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(cfg.API.JWTSecret), nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		http.Error(w, "Invalid token", http.StatusForbidden)
+		return nil, false
+	}
+
+	jwtID, _ := claims["jti"].(string)
+	if a.keys == nil {
+		log.Printf("auth: no key store open, rejecting token %s", jwtID)
+		http.Error(w, "Invalid or expired API key", http.StatusForbidden)
+		return nil, false
+	}
+	isValid, userID := a.keys.Valid(jwtID)
+	if jwtID == "" || !isValid {
+		http.Error(w, "Invalid or expired API key", http.StatusForbidden)
+		return nil, false
+	}
+
+	acc := &Access{UserID: userID, Resources: []string{}}
+	allowedResources, _ := claims["allowed_resources"].([]interface{})
+	for _, res := range allowedResources {
+		if s, ok := res.(string); ok {
+			acc.Resources = append(acc.Resources, s)
+		}
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		acc.Expires = exp.Time
+	}
+	return acc, true
+}
+
+// bearerToken extracts the token from "Authorization: Bearer <token>".
+// Browsers cannot set headers on a WebSocket handshake or an EventSource
+// request, so upgrades and the SSE stream may pass it as ?access_token=
+// instead.
+func bearerToken(r *http.Request) string {
+	tokenParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(tokenParts) == 2 && tokenParts[0] == "Bearer" {
+		return tokenParts[1]
+	}
+	if websocket.IsWebSocketUpgrade(r) || r.URL.Path == alertStreamPath {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// CheckOrigin accepts WebSocket upgrades from the configured origins, or
+// from the serving host when none are configured. Requests without an
+// Origin header do not come from a browser and are let through to the
+// token check.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	cfg, _ := a.live.Current()
+	if len(cfg.API.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range cfg.API.AllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
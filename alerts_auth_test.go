@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		want    string
+	}{
+		{"header", "/api/rules", map[string]string{"Authorization": "Bearer abc"}, "abc"},
+		{"header wins over query", alertStreamPath + "?access_token=q", map[string]string{"Authorization": "Bearer abc"}, "abc"},
+		{"websocket upgrade", "/ws?access_token=q", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, "q"},
+		{"event stream", alertStreamPath + "?access_token=q", nil, "q"},
+		{"query elsewhere", "/api/rules?access_token=q", nil, ""},
+		{"not bearer", "/api/rules", map[string]string{"Authorization": "Basic abc"}, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := bearerToken(r); got != tt.want {
+			t.Errorf("%s: bearerToken = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ---------------- BACKTEST ----------------
+//
+//	alerts backtest -rules rules.yaml -data samples.jsonl
+//
+// replays recorded samples through the evaluator on simulated time and
+// reports when every alert would have fired and resolved. Samples are
+// either JSON lines,
+//
+//	{"time": "2026-10-10T12:00:00Z", "metrics": {"cpu": 1.5, "memory": 3e9}}
+//
+// or CSV, wide (time,cpu,memory,...) or long (time,metric,value). Times are
+// RFC 3339 or Unix seconds.
+
+type tick struct {
+	time    time.Time
+	metrics map[string]float64
+}
+
+// FiringInterval is one episode of an alert instance in the firing state.
+type FiringInterval struct {
+	Alert      string            `json:"alert"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	FiredAt    time.Time         `json:"fired_at"`
+	ResolvedAt time.Time         `json:"resolved_at,omitempty"`
+	Open       bool              `json:"open,omitempty"` // still firing at the end of the data
+}
+
+func (f FiringInterval) Duration(end time.Time) time.Duration {
+	if f.Open {
+		return end.Sub(f.FiredAt)
+	}
+	return f.ResolvedAt.Sub(f.FiredAt)
+}
+
+// Backtest runs cfg over ticks, which must be sorted by time.
+func Backtest(cfg Config, ticks []tick) []FiringInterval {
+	evaluator := NewEvaluator()
+	open := make(map[string]int) // instance key -> index into out
+	var out []FiringInterval
+
+	for _, t := range ticks {
+		for _, e := range evaluator.Step(cfg, t.metrics, t.time) {
+			switch e.State {
+			case StateFiring:
+				if e.Previous == StateFiring {
+					// Only a tag such as flapping changed.
+					continue
+				}
+				open[e.Instance] = len(out)
+				out = append(out, FiringInterval{Alert: e.Alert, Labels: e.Labels, FiredAt: e.FiredAt, Open: true})
+			case StateResolved:
+				if i, ok := open[e.Instance]; ok {
+					out[i].ResolvedAt = e.ResolvedAt
+					out[i].Open = false
+					delete(open, e.Instance)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func runBacktest(args []string) error {
+	fs := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	rulesPath := fs.String("rules", "rules.yaml", "rules file to evaluate")
+	dataPath := fs.String("data", "", "recorded samples (.jsonl or .csv)")
+	asJSON := fs.Bool("json", false, "print intervals as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dataPath == "" {
+		return fmt.Errorf("-data is required")
+	}
+
+	v := viper.New()
+	v.SetConfigFile(*rulesPath)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	cfg, err := loadConfig(v)
+	if err != nil {
+		return err
+	}
+	if err := compileConfig(&cfg); err != nil {
+		return err
+	}
+
+	ticks, err := readSamples(*dataPath)
+	if err != nil {
+		return err
+	}
+	if len(ticks) == 0 {
+		return fmt.Errorf("%s: no samples", *dataPath)
+	}
+
+	intervals := Backtest(cfg, ticks)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(intervals)
+	}
+	printBacktestReport(os.Stdout, intervals, ticks[0].time, ticks[len(ticks)-1].time)
+	return nil
+}
+
+func printBacktestReport(w io.Writer, intervals []FiringInterval, start, end time.Time) {
+	fmt.Fprintf(w, "Replayed %s to %s (%s)\n\n", start.Format(time.RFC3339), end.Format(time.RFC3339), end.Sub(start).Round(time.Second))
+	if len(intervals) == 0 {
+		fmt.Fprintln(w, "No alerts fired.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALERT\tFIRED\tRESOLVED\tDURATION")
+	counts := make(map[string]int)
+	for _, f := range intervals {
+		resolved := f.ResolvedAt.Format(time.RFC3339)
+		if f.Open {
+			resolved = "(still firing)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", f.Alert, f.FiredAt.Format(time.RFC3339), resolved, f.Duration(end).Round(time.Second))
+		counts[f.Alert]++
+	}
+	tw.Flush()
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s fired %d time(s)\n", name, counts[name])
+	}
+}
+
+// ---------------- SAMPLE FILES ----------------
+
+func readSamples(path string) ([]tick, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ticks []tick
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		ticks, err = readCSVSamples(f)
+	} else {
+		ticks, err = readJSONLSamples(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	sort.SliceStable(ticks, func(i, j int) bool { return ticks[i].time.Before(ticks[j].time) })
+	return ticks, nil
+}
+
+func readJSONLSamples(r io.Reader) ([]tick, error) {
+	var ticks []tick
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+
+		var rec struct {
+			Time    json.RawMessage    `json:"time"`
+			Metrics map[string]float64 `json:"metrics"`
+		}
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		var raw interface{}
+		if err := json.Unmarshal(rec.Time, &raw); err != nil {
+			return nil, fmt.Errorf("line %d: missing time", line)
+		}
+		t, err := parseSampleTime(fmt.Sprint(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ticks = append(ticks, tick{time: t, metrics: rec.Metrics})
+	}
+	return ticks, sc.Err()
+}
+
+func readCSVSamples(r io.Reader) ([]tick, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, nil
+	}
+	header := rows[0]
+	if len(header) < 2 || strings.ToLower(header[0]) != "time" {
+		return nil, fmt.Errorf("first column must be time")
+	}
+
+	long := len(header) == 3 && strings.ToLower(header[1]) == "metric" && strings.ToLower(header[2]) == "value"
+	byTime := make(map[time.Time]map[string]float64)
+	var order []time.Time
+
+	for i, row := range rows[1:] {
+		t, err := parseSampleTime(row[0])
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", i+2, err)
+		}
+		metrics, ok := byTime[t]
+		if !ok {
+			metrics = make(map[string]float64)
+			byTime[t] = metrics
+			order = append(order, t)
+		}
+
+		if long {
+			v, err := strconv.ParseFloat(row[2], 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: %v", i+2, err)
+			}
+			metrics[row[1]] = v
+			continue
+		}
+		for c := 1; c < len(row) && c < len(header); c++ {
+			if row[c] == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(row[c], 64)
+			if err != nil {
+				return nil, fmt.Errorf("row %d, %s: %v", i+2, header[c], err)
+			}
+			metrics[header[c]] = v
+		}
+	}
+
+	ticks := make([]tick, len(order))
+	for i, t := range order {
+		ticks[i] = tick{time: t, metrics: byTime[t]}
+	}
+	return ticks, nil
+}
+
+func parseSampleTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Unix(0, int64(secs*float64(time.Second))).UTC(), nil
+}
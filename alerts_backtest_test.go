@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSamples(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadSamples(t *testing.T) {
+	t0 := time.Date(2026, 10, 10, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"samples.jsonl": `{"time": "2026-10-10T12:01:00Z", "metrics": {"cpu": 3}}
+
+{"time": 1791633600, "metrics": {"cpu": 1, "memory": 5}}
+`,
+		"wide.csv": "time,cpu,memory\n2026-10-10T12:01:00Z,3,\n1791633600,1,5\n",
+		"long.csv": "time,metric,value\n2026-10-10T12:01:00Z,cpu,3\n1791633600,cpu,1\n1791633600,memory,5\n",
+	}
+	for name, content := range files {
+		ticks, err := readSamples(writeSamples(t, name, content))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if len(ticks) != 2 {
+			t.Errorf("%s: %d ticks, want 2", name, len(ticks))
+			continue
+		}
+		if !ticks[0].time.Equal(t0) || ticks[0].metrics["cpu"] != 1 || ticks[0].metrics["memory"] != 5 {
+			t.Errorf("%s: first tick = %v %v, want %v cpu 1 memory 5", name, ticks[0].time, ticks[0].metrics, t0)
+		}
+		if !ticks[1].time.Equal(t0.Add(time.Minute)) || len(ticks[1].metrics) != 1 || ticks[1].metrics["cpu"] != 3 {
+			t.Errorf("%s: second tick = %v %v", name, ticks[1].time, ticks[1].metrics)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"bad.jsonl": `{"metrics": {"cpu": 1}}`,
+		"time.csv":  "when,cpu\n1,2\n",
+		"value.csv": "time,cpu\n1,high\n",
+	} {
+		if _, err := readSamples(writeSamples(t, name, content)); err == nil {
+			t.Errorf("%s: read without error", name)
+		}
+	}
+}
+
+func TestBacktestTiming(t *testing.T) {
+	cfg := Config{Alerts: []Alert{
+		{Name: "cpu_high", For: 2 * time.Minute, Rule: Rule{Condition: "cpu > 2"}},
+		{Name: "mem_high", Rule: Rule{Condition: "memory > 10"}},
+	}}
+	if err := compileConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2026, 10, 10, 12, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+	cpu := []float64{1, 3, 3, 3, 3, 1, 3, 3, 1, 3, 3, 3, 3}
+	var ticks []tick
+	for m, v := range cpu {
+		metrics := map[string]float64{"cpu": v, "memory": 1}
+		if m >= 11 {
+			metrics["memory"] = 20
+		}
+		ticks = append(ticks, tick{time: at(m), metrics: metrics})
+	}
+
+	got := Backtest(cfg, ticks)
+	want := []FiringInterval{
+		{Alert: "cpu_high", FiredAt: at(3), ResolvedAt: at(5)},
+		{Alert: "cpu_high", FiredAt: at(11), Open: true},
+		{Alert: "mem_high", FiredAt: at(11), Open: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("intervals = %+v, want %+v", got, want)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Alert != w.Alert || !g.FiredAt.Equal(w.FiredAt) || !g.ResolvedAt.Equal(w.ResolvedAt) || g.Open != w.Open {
+			t.Errorf("interval %d = %+v, want %+v", i, g, w)
+		}
+	}
+	end := at(len(cpu) - 1)
+	if d := got[0].Duration(end); d != 2*time.Minute {
+		t.Errorf("closed duration = %s, want 2m", d)
+	}
+	if d := got[1].Duration(end); d != time.Minute {
+		t.Errorf("open duration = %s, want 1m", d)
+	}
+
+	var buf bytes.Buffer
+	printBacktestReport(&buf, got, t0, end)
+	report := buf.String()
+	for _, line := range []string{
+		"Replayed 2026-10-10T12:00:00Z to 2026-10-10T12:12:00Z (12m0s)",
+		"(still firing)",
+		"cpu_high fired 2 time(s)",
+		"mem_high fired 1 time(s)",
+	} {
+		if !strings.Contains(report, line) {
+			t.Errorf("report lacks %q:\n%s", line, report)
+		}
+	}
+}
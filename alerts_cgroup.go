@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+// ---------------- CGROUPS ----------------
+
+// CgroupMatch names a cgroup to watch besides the collector's own:
+//
+//	sources:
+//	  - name: containers
+//	    type: cgroup
+//	    path: /sys/fs/cgroup         # cgroup v2 mount, the default
+//	    cgroups:
+//	      - name: nginx
+//	        path: system.slice/nginx.service
+//
+// The collector's own cgroup is published as "self". Every cgroup gets
+//
+//	cgroup.<name>.cpu.cores              cores in use since the last collection
+//	cgroup.<name>.cpu.limit_cores        cpu.max quota, host cores when unlimited
+//	cgroup.<name>.cpu.used_pct           cores in use against the limit
+//	cgroup.<name>.cpu.throttled_pct      periods throttled since the last collection
+//	cgroup.<name>.memory.used_bytes      memory.current
+//	cgroup.<name>.memory.limit_bytes     memory.max, host memory when unlimited
+//	cgroup.<name>.memory.used_pct
+//	cgroup.<name>.memory.oom, .oom_kill  counters from memory.events
+//	cgroup.<name>.io.read_bytes, .write_bytes, .read_ops, .write_ops
+//	                                     counters from io.stat, summed over devices
+//
+// and the same as labeled series, e.g. cgroup.memory.used_pct{cgroup="nginx"}.
+// Limits are the tightest along the path to the root, so a cgroup without
+// its own cpu.max still reports its parent's. The cpu rates are missing
+// until the second collection, and files a cgroup does not have (a
+// controller not enabled for it) simply leave their metrics out.
+type CgroupMatch struct {
+	Name string `mapstructure:"name"`
+	Path string `mapstructure:"path"`
+}
+
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// cgroupSelfFile lists the cgroups of this process; the v2 entry is the
+// line starting with "0::".
+var cgroupSelfFile = "/proc/self/cgroup"
+
+type cgroupTarget struct {
+	name string
+	rel  string // path below the root, "" for the root itself
+}
+
+// cgroupCPU is what cpu.stat held at the last collection.
+type cgroupCPU struct {
+	usage, periods, throttled float64
+	at                        time.Time
+}
+
+type cgroupSource struct {
+	root    string
+	targets []cgroupTarget
+
+	mu   sync.Mutex
+	prev map[string]cgroupCPU
+}
+
+func newCgroupSource(sc SourceConfig) (MetricSource, error) {
+	root := sc.Path
+	if root == "" {
+		root = defaultCgroupRoot
+	}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 mount: %v", root, err)
+	}
+
+	self, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	src := &cgroupSource{
+		root:    root,
+		targets: []cgroupTarget{{name: "self", rel: self}},
+		prev:    make(map[string]cgroupCPU),
+	}
+
+	seen := map[string]bool{"self": true}
+	for i, cm := range sc.Cgroups {
+		if !validMetricSegment(cm.Name) {
+			return nil, fmt.Errorf("cgroups[%d]: name %q must be a letter followed by letters, digits or _", i, cm.Name)
+		}
+		if seen[cm.Name] {
+			return nil, fmt.Errorf("cgroups[%d]: duplicate name %q", i, cm.Name)
+		}
+		seen[cm.Name] = true
+
+		rel := strings.Trim(path.Clean("/"+cm.Path), "/")
+		if cm.Path == "" || strings.HasPrefix(rel, "..") {
+			return nil, fmt.Errorf("cgroups[%d]: path %q must be below the cgroup root", i, cm.Path)
+		}
+		src.targets = append(src.targets, cgroupTarget{name: cm.Name, rel: rel})
+	}
+	return src, nil
+}
+
+// ownCgroup returns this process's cgroup relative to the mount. Inside a
+// container with its own cgroup namespace that is the root itself.
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile(cgroupSelfFile)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.Trim(path.Clean(strings.TrimPrefix(line, "0::")), "/"), nil
+		}
+	}
+	return "", fmt.Errorf("%s: no cgroup v2 entry", cgroupSelfFile)
+}
+
+func (s *cgroupSource) Collect(ctx context.Context) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	metrics := make(map[string]float64)
+	for _, t := range s.targets {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(s.root, filepath.FromSlash(t.rel))
+		if _, err := os.Stat(dir); err != nil {
+			// A watched service that is not running has no cgroup.
+			if t.name == "self" {
+				return nil, err
+			}
+			continue
+		}
+
+		labels := Labels{"cgroup": t.name}
+		for field, v := range s.collectOne(t, dir, now) {
+			metrics["cgroup."+t.name+"."+field] = v
+			metrics[seriesKey("cgroup."+field, labels)] = v
+		}
+	}
+	return metrics, nil
+}
+
+func (s *cgroupSource) collectOne(t cgroupTarget, dir string, now time.Time) map[string]float64 {
+	values := make(map[string]float64)
+
+	limit := s.cpuLimit(t.rel)
+	values["cpu.limit_cores"] = limit
+	if stat, err := readKeyedFile(filepath.Join(dir, "cpu.stat")); err == nil {
+		cur := cgroupCPU{usage: stat["usage_usec"], periods: stat["nr_periods"], throttled: stat["nr_throttled"], at: now}
+		if prev, ok := s.prev[t.name]; ok && cur.usage >= prev.usage {
+			if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+				cores := (cur.usage - prev.usage) / 1e6 / elapsed
+				values["cpu.cores"] = cores
+				values["cpu.used_pct"] = cores / limit * 100
+			}
+			if periods := cur.periods - prev.periods; periods > 0 {
+				values["cpu.throttled_pct"] = (cur.throttled - prev.throttled) / periods * 100
+			} else {
+				values["cpu.throttled_pct"] = 0
+			}
+		}
+		s.prev[t.name] = cur
+	}
+
+	if used, err := readCgroupValue(filepath.Join(dir, "memory.current")); err == nil {
+		limit := s.memoryLimit(t.rel)
+		values["memory.used_bytes"] = used
+		values["memory.limit_bytes"] = limit
+		if limit > 0 {
+			values["memory.used_pct"] = used / limit * 100
+		}
+	}
+	if events, err := readKeyedFile(filepath.Join(dir, "memory.events")); err == nil {
+		values["memory.oom"] = events["oom"]
+		values["memory.oom_kill"] = events["oom_kill"]
+	}
+
+	if stat, err := readIOStat(filepath.Join(dir, "io.stat")); err == nil {
+		values["io.read_bytes"] = stat["rbytes"]
+		values["io.write_bytes"] = stat["wbytes"]
+		values["io.read_ops"] = stat["rios"]
+		values["io.write_ops"] = stat["wios"]
+	}
+	return values
+}
+
+// cpuLimit returns the tightest cpu.max quota, in cores, from rel up to
+// the root, or the host's cores when none is set.
+func (s *cgroupSource) cpuLimit(rel string) float64 {
+	limit := float64(runtime.NumCPU())
+	s.walkUp(rel, func(dir string) {
+		data, err := os.ReadFile(filepath.Join(dir, "cpu.max"))
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return
+		}
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 == nil && err2 == nil && period > 0 && quota/period < limit {
+			limit = quota / period
+		}
+	})
+	return limit
+}
+
+// memoryLimit returns the tightest memory.max from rel up to the root, or
+// the host's memory when none is set.
+func (s *cgroupSource) memoryLimit(rel string) float64 {
+	var limit float64
+	if vm, err := mem.VirtualMemory(); err == nil {
+		limit = float64(vm.Total)
+	}
+	s.walkUp(rel, func(dir string) {
+		if v, err := readCgroupValue(filepath.Join(dir, "memory.max")); err == nil && v > 0 && (limit == 0 || v < limit) {
+			limit = v
+		}
+	})
+	return limit
+}
+
+// walkUp calls fn for the directory of rel and of each of its ancestors up
+// to the mount. The host's root cgroup has no limit files, but in a
+// container's cgroup namespace the mount is the container's own cgroup.
+func (s *cgroupSource) walkUp(rel string, fn func(dir string)) {
+	for {
+		fn(filepath.Join(s.root, filepath.FromSlash(rel)))
+		if rel == "" || rel == "." {
+			return
+		}
+		rel = path.Dir(rel)
+		if rel == "." {
+			rel = ""
+		}
+	}
+}
+
+// readCgroupValue reads a single-value file such as memory.current.
+// "max" is reported as an error, so callers fall back to their default.
+func readCgroupValue(file string) (float64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, fmt.Errorf("%s: no limit", file)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// readKeyedFile reads "key value" lines, as in cpu.stat and memory.events.
+func readKeyedFile(file string) (map[string]float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]float64)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			out[fields[0]] = v
+		}
+	}
+	return out, sc.Err()
+}
+
+// readIOStat sums the key=value counters of io.stat over every device:
+//
+//	8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0
+func readIOStat(file string) (map[string]float64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]float64)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				out[k] += n
+			}
+		}
+	}
+	return out, sc.Err()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// writeCgroupFiles creates files below root, keyed by slash-separated path.
+func writeCgroupFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCgroupLimitsWalkUp(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu memory io\n",
+		"a/cpu.max":          "50000 100000\n",
+		"a/memory.max":       "1073741824\n",
+		"a/b/cpu.max":        "max 100000\n",
+		"a/b/memory.max":     "max\n",
+		"a/b/c/cgroup.procs": "",
+		"x/cpu.max":          "400000 100000\n",
+		"x/memory.max":       "2147483648\n",
+		"x/y/cpu.max":        "100000 100000\n",
+		"x/y/memory.max":     "536870912\n",
+	})
+	s := &cgroupSource{root: root}
+
+	tests := []struct {
+		rel         string
+		cores, mem  float64
+		hostMemory  bool
+		description string
+	}{
+		{rel: "a/b/c", cores: 0.5, mem: 1 << 30, description: "no files, max parent, limited grandparent"},
+		{rel: "a/b", cores: 0.5, mem: 1 << 30, description: "max overridden by the parent"},
+		{rel: "x/y", cores: 1, mem: 512 << 20, description: "child tighter than parent"},
+		{rel: "", cores: float64(runtime.NumCPU()), hostMemory: true, description: "unlimited root"},
+	}
+	for _, tt := range tests {
+		if got := s.cpuLimit(tt.rel); got != tt.cores {
+			t.Errorf("cpuLimit(%q) = %v, want %v (%s)", tt.rel, got, tt.cores, tt.description)
+		}
+		got := s.memoryLimit(tt.rel)
+		if tt.hostMemory {
+			if got <= 0 {
+				t.Errorf("memoryLimit(%q) = %v, want the host's memory", tt.rel, got)
+			}
+		} else if got != tt.mem {
+			t.Errorf("memoryLimit(%q) = %v, want %v (%s)", tt.rel, got, tt.mem, tt.description)
+		}
+	}
+}
+
+func TestReadIOStatSumsDevices(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"io.stat": "8:0 rbytes=1000 wbytes=2000 rios=10 wios=20 dbytes=0 dios=0\n" +
+			"8:16 rbytes=500 wbytes=250 rios=5 wios=2 dbytes=0 dios=0\n" +
+			"\n",
+	})
+	got, err := readIOStat(filepath.Join(root, "io.stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"rbytes": 1500, "wbytes": 2250, "rios": 15, "wios": 22}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestCgroupCPUDeltas(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu memory io\n",
+		"app/cpu.max":        "50000 100000\n",
+		"app/cpu.stat":       "usage_usec 1000000\nnr_periods 100\nnr_throttled 10\n",
+	})
+	s := &cgroupSource{root: root, prev: make(map[string]cgroupCPU)}
+	target := cgroupTarget{name: "app", rel: "app"}
+	dir := filepath.Join(root, "app")
+	t0 := time.Unix(1000, 0)
+
+	first := s.collectOne(target, dir, t0)
+	for _, field := range []string{"cpu.cores", "cpu.used_pct", "cpu.throttled_pct"} {
+		if _, ok := first[field]; ok {
+			t.Errorf("%s reported on the first collection", field)
+		}
+	}
+	if first["cpu.limit_cores"] != 0.5 {
+		t.Errorf("cpu.limit_cores = %v, want 0.5", first["cpu.limit_cores"])
+	}
+
+	// 0.5s of cpu over 2s, 25 of 100 periods throttled.
+	writeCgroupFiles(t, root, map[string]string{
+		"app/cpu.stat": "usage_usec 1500000\nnr_periods 200\nnr_throttled 35\n",
+	})
+	second := s.collectOne(target, dir, t0.Add(2*time.Second))
+	want := map[string]float64{"cpu.cores": 0.25, "cpu.used_pct": 50, "cpu.throttled_pct": 25}
+	for field, v := range want {
+		if got, ok := second[field]; !ok || math.Abs(got-v) > 1e-9 {
+			t.Errorf("%s = %v, want %v", field, got, v)
+		}
+	}
+
+	// No new periods: nothing was throttled.
+	third := s.collectOne(target, dir, t0.Add(4*time.Second))
+	if third["cpu.throttled_pct"] != 0 || third["cpu.cores"] != 0 {
+		t.Errorf("idle collection = %v, want 0 cores and 0 throttled", third)
+	}
+}
+
+func TestCgroupCollect(t *testing.T) {
+	root := t.TempDir()
+	writeCgroupFiles(t, root, map[string]string{
+		"cgroup.controllers":       "cpu memory io\n",
+		"svc/app/memory.current":   "268435456\n",
+		"svc/app/memory.max":       "1073741824\n",
+		"svc/app/memory.events":    "low 0\nhigh 0\nmax 3\noom 2\noom_kill 1\n",
+		"svc/other/memory.current": "1\n",
+		"self.cgroup":              "0::/svc/app\n",
+	})
+	saved := cgroupSelfFile
+	cgroupSelfFile = filepath.Join(root, "self.cgroup")
+	defer func() { cgroupSelfFile = saved }()
+
+	src, err := newCgroupSource(SourceConfig{Path: root, Cgroups: []CgroupMatch{
+		{Name: "other", Path: "svc/other"},
+		{Name: "gone", Path: "svc/gone"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := src.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]float64{
+		"cgroup.self.memory.used_bytes":            256 << 20,
+		"cgroup.self.memory.used_pct":              25,
+		"cgroup.self.memory.oom_kill":              1,
+		`cgroup.memory.used_pct{cgroup="self"}`:    25,
+		`cgroup.memory.used_bytes{cgroup="other"}`: 1,
+		`cgroup.memory.limit_bytes{cgroup="self"}`: 1 << 30,
+		"cgroup.other.memory.used_bytes":           1,
+		`cgroup.cpu.limit_cores{cgroup="self"}`:    float64(runtime.NumCPU()),
+	}
+	for key, v := range want {
+		if got, ok := metrics[key]; !ok || got != v {
+			t.Errorf("%s = %v (present %v), want %v", key, got, ok, v)
+		}
+	}
+	for key := range metrics {
+		if _, labels, _ := parseSeriesKey(key); labels["cgroup"] == "gone" {
+			t.Errorf("missing cgroup reported: %s", key)
+		}
+	}
+}
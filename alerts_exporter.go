@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- PROMETHEUS EXPORTER ----------------
+
+// evalDurationBuckets are the upper bounds, in seconds, of the evaluation
+// duration histogram.
+var evalDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // cumulative per bound
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// snapshot returns a copy that later observations do not change.
+func (h *histogram) snapshot() histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return c
+}
+
+// ActiveAlert is a pending or firing alert instance.
+type ActiveAlert struct {
+	Name     string
+	Instance string // as in AlertEvent
+	Labels   Labels
+	State    AlertState
+}
+
+// Exporter serves what the evaluator last saw in the Prometheus text
+// exposition format on /metrics.
+type Exporter struct {
+	mu       sync.Mutex
+	metrics  map[string]float64
+	alerts   []ActiveAlert
+	duration *histogram
+	hub      *Hub
+}
+
+func NewExporter(hub *Hub) *Exporter {
+	return &Exporter{duration: newHistogram(evalDurationBuckets), hub: hub}
+}
+
+// Observe records the result of one evaluation tick.
+func (x *Exporter) Observe(metrics map[string]float64, alerts []ActiveAlert, took time.Duration) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.metrics = metrics
+	x.alerts = alerts
+	x.duration.observe(took.Seconds())
+}
+
+func (x *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Observe replaces the metrics map and alerts slice rather than
+	// changing them, so holding on to them past the lock is safe. A slow
+	// scrape must not stall the evaluation loop.
+	x.mu.Lock()
+	metrics := x.metrics
+	alerts := append([]ActiveAlert(nil), x.alerts...)
+	h := x.duration.snapshot()
+	x.mu.Unlock()
+
+	writeCollected(w, metrics)
+
+	fmt.Fprintln(w, "# HELP ALERTS Pending and firing alert instances.")
+	fmt.Fprintln(w, "# TYPE ALERTS gauge")
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Name+alerts[i].Labels.Key() < alerts[j].Name+alerts[j].Labels.Key()
+	})
+	for _, a := range alerts {
+		labels := a.Labels.Merge(Labels{"alertname": a.Name, "alertstate": string(a.State)})
+		fmt.Fprintf(w, "ALERTS%s 1\n", promLabels(labels))
+	}
+
+	fmt.Fprintln(w, "# HELP alerts_evaluation_duration_seconds Time taken by one evaluation tick.")
+	fmt.Fprintln(w, "# TYPE alerts_evaluation_duration_seconds histogram")
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "alerts_evaluation_duration_seconds_bucket{le=%q} %d\n", promFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "alerts_evaluation_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+	fmt.Fprintf(w, "alerts_evaluation_duration_seconds_sum %s\n", promFloat(h.sum))
+	fmt.Fprintf(w, "alerts_evaluation_duration_seconds_count %d\n", h.count)
+
+	fmt.Fprintln(w, "# HELP alerts_websocket_clients Connected WebSocket clients.")
+	fmt.Fprintln(w, "# TYPE alerts_websocket_clients gauge")
+	fmt.Fprintf(w, "alerts_websocket_clients %d\n", x.hub.ClientCount())
+}
+
+// writeCollected writes every collected series as a gauge. Names are
+// mapped onto the Prometheus character set, so disk./.used_pct is exported
+// as disk___used_pct.
+func writeCollected(w io.Writer, metrics map[string]float64) {
+	type line struct {
+		name   string
+		labels string
+		value  float64
+	}
+
+	byName := make(map[string][]line)
+	seen := make(map[string]bool)
+	for key, v := range metrics {
+		name, labels, err := parseSeriesKey(key)
+		if err != nil {
+			continue
+		}
+		name = promName(name)
+		l := line{name: name, labels: promLabels(labels), value: v}
+		if seen[l.name+l.labels] {
+			continue
+		}
+		seen[l.name+l.labels] = true
+		byName[name] = append(byName[name], l)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		lines := byName[name]
+		sort.Slice(lines, func(i, j int) bool { return lines[i].labels < lines[j].labels })
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		for _, l := range lines {
+			fmt.Fprintf(w, "%s%s %s\n", l.name, l.labels, promFloat(l.value))
+		}
+	}
+}
+
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(isIdentChar(c) || c == ':') || (i == 0 && isDigit(c)) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func promLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts[i] = strings.ReplaceAll(promName(k), ":", "_") + `="` + v + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func promFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
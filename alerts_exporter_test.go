@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporterOutput(t *testing.T) {
+	x := NewExporter(NewHub(nil))
+	metrics := map[string]float64{
+		"cpu":             2.5,
+		"disk./.used_pct": 91,
+		seriesKey("disk.used_pct", Labels{"mount": "/"}):            91,
+		seriesKey("disk.used_pct", Labels{"mount": `/mnt/"x"`}):     1e-7,
+		seriesKey("net.rx_bytes", Labels{"iface": "eth0"}):          math.Inf(1),
+		seriesKey("proc.count", Labels{"group": "web", "1st": "y"}): math.NaN(),
+	}
+	alerts := []ActiveAlert{
+		{Name: "disk_full", Labels: Labels{"mount": "/"}, State: StateFiring},
+		{Name: "cpu_high", State: StatePending},
+	}
+	x.Observe(nil, nil, 31250*time.Microsecond)
+	x.Observe(nil, nil, 2*time.Second)
+	x.Observe(metrics, alerts, 5*time.Second)
+
+	rec := httptest.NewRecorder()
+	x.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	want := `# TYPE cpu gauge
+cpu 2.5
+# TYPE disk___used_pct gauge
+disk___used_pct 91
+# TYPE disk_used_pct gauge
+disk_used_pct{mount="/"} 91
+disk_used_pct{mount="/mnt/\"x\""} 1e-07
+# TYPE net_rx_bytes gauge
+net_rx_bytes{iface="eth0"} +Inf
+# TYPE proc_count gauge
+proc_count{_st="y",group="web"} NaN
+# HELP ALERTS Pending and firing alert instances.
+# TYPE ALERTS gauge
+ALERTS{alertname="cpu_high",alertstate="pending"} 1
+ALERTS{alertname="disk_full",alertstate="firing",mount="/"} 1
+# HELP alerts_evaluation_duration_seconds Time taken by one evaluation tick.
+# TYPE alerts_evaluation_duration_seconds histogram
+alerts_evaluation_duration_seconds_bucket{le="0.001"} 0
+alerts_evaluation_duration_seconds_bucket{le="0.005"} 0
+alerts_evaluation_duration_seconds_bucket{le="0.01"} 0
+alerts_evaluation_duration_seconds_bucket{le="0.025"} 0
+alerts_evaluation_duration_seconds_bucket{le="0.05"} 1
+alerts_evaluation_duration_seconds_bucket{le="0.1"} 1
+alerts_evaluation_duration_seconds_bucket{le="0.25"} 1
+alerts_evaluation_duration_seconds_bucket{le="0.5"} 1
+alerts_evaluation_duration_seconds_bucket{le="1"} 1
+alerts_evaluation_duration_seconds_bucket{le="2.5"} 2
+alerts_evaluation_duration_seconds_bucket{le="+Inf"} 3
+alerts_evaluation_duration_seconds_sum 7.03125
+alerts_evaluation_duration_seconds_count 3
+# HELP alerts_websocket_clients Connected WebSocket clients.
+# TYPE alerts_websocket_clients gauge
+alerts_websocket_clients 0
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// stalledWriter is a ResponseWriter whose client stops reading after the
+// first write.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	wrote, release chan struct{}
+}
+
+func (w *stalledWriter) Write(b []byte) (int, error) {
+	select {
+	case w.wrote <- struct{}{}:
+		<-w.release
+	default:
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestExporterSlowScrape(t *testing.T) {
+	x := NewExporter(NewHub(nil))
+	x.Observe(map[string]float64{"cpu": 1}, nil, time.Millisecond)
+
+	w := &stalledWriter{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		x.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	<-w.wrote
+
+	observed := make(chan struct{})
+	go func() {
+		x.Observe(map[string]float64{"cpu": 2}, nil, time.Millisecond)
+		close(observed)
+	}()
+	select {
+	case <-observed:
+	case <-time.After(5 * time.Second):
+		t.Error("Observe blocked behind a stalled scrape")
+	}
+	close(w.release)
+	<-done
+	if !strings.Contains(w.Body.String(), "cpu 1\n") || !strings.Contains(w.Body.String(), "alerts_evaluation_duration_seconds_count 1\n") {
+		t.Errorf("scrape mixed in the later observation:\n%s", w.Body)
+	}
+}
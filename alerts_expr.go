@@ -0,0 +1,814 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------- CONDITION EXPRESSIONS ----------------
+//
+// Conditions are small arithmetic/boolean expressions over metric names:
+//
+//	memory / memory.total * 100 > 85
+//	cpu > 2 and not (load1 < 1)
+//	max(disk./.used_pct, disk./var.used_pct) >= 90
+//	rate(net.eth0.rx_bytes[1m]) > 10MiB
+//	disk.used_pct{mount=~"/var.*"} > 90
+//
+// Metric names may contain dots. A dot-separated segment that starts with
+// "/" is a path (e.g. a mount point) and may itself contain "/" and "-", so
+// division directly after such a segment needs surrounding spaces.
+// Comparisons and boolean operators yield 1 or 0; a condition holds when it
+// evaluates to a non-zero number.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokRange // [5m] after a metric name
+)
+
+type token struct {
+	kind     tokenKind
+	text     string
+	num      float64
+	unit     unitKind
+	window   time.Duration
+	matchers []labelMatcher
+	pos      int
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				j := i + 1
+				if j < len(src) && (src[j] == '+' || src[j] == '-') {
+					j++
+				}
+				if j < len(src) && isDigit(src[j]) {
+					i = j
+					for i < len(src) && isDigit(src[i]) {
+						i++
+					}
+				}
+			}
+			for i < len(src) && (isIdentStart(src[i]) || src[i] == '%') {
+				i++
+			}
+			num, unit, err := parseWithUnits(src[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %v", start, err)
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], num: num, unit: unit, pos: start})
+
+		case isIdentStart(c):
+			start := i
+			i = scanIdent(src, i)
+			tok := token{kind: tokIdent, text: src[start:i], pos: start}
+			if i < len(src) && src[i] == '{' {
+				end, err := scanBraces(src, i)
+				if err != nil {
+					return nil, err
+				}
+				if tok.matchers, err = parseMatchers(src[i+1 : end-1]); err != nil {
+					return nil, fmt.Errorf("at %d: %v", i, err)
+				}
+				i = end
+			}
+			toks = append(toks, tok)
+
+		case c == '(':
+			toks = append(toks, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			toks = append(toks, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			toks = append(toks, token{kind: tokComma, text: ",", pos: i})
+			i++
+		case c == '[':
+			end := strings.IndexByte(src[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("at %d: unterminated range", i)
+			}
+			text := src[i+1 : i+end]
+			window, err := parseWindow(text)
+			if err != nil {
+				return nil, fmt.Errorf("at %d: %v", i, err)
+			}
+			toks = append(toks, token{kind: tokRange, text: text, window: window, pos: i})
+			i += end + 1
+
+		default:
+			op := ""
+			for _, cand := range []string{">=", "<=", "==", "!=", "&&", "||", ">", "<", "+", "-", "*", "/", "%", "!"} {
+				if strings.HasPrefix(src[i:], cand) {
+					op = cand
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("at %d: unexpected character %q", i, c)
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// parseWindow parses a range such as 30s, 5m, 4h or 7d.
+func parseWindow(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil || math.IsNaN(days) || math.Abs(days) > math.MaxInt64/float64(24*time.Hour) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = time.Duration(days * float64(24*time.Hour))
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
+// scanIdent returns the end of the metric name starting at i.
+func scanIdent(src string, i int) int {
+	pathSegment := false
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case isIdentChar(c):
+			i++
+		case c == '.':
+			pathSegment = i+1 < len(src) && src[i+1] == '/'
+			if !pathSegment && (i+1 >= len(src) || !isIdentChar(src[i+1])) {
+				return i
+			}
+			i++
+		case pathSegment && (c == '/' || c == '-'):
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// ---------------- AST ----------------
+
+type Expr interface {
+	Eval(env *evalEnv) (float64, error)
+	String() string
+}
+
+type evalEnv struct {
+	metrics   map[string]float64
+	index     seriesIndex
+	instance  Labels // labels of the alert instance being evaluated
+	history   *MetricHistory
+	baselines *Baselines
+	now       time.Time
+}
+
+// resolve returns the series key sel refers to for the current instance.
+func (env *evalEnv) resolve(sel *metricExpr) (string, bool) {
+	if env.index == nil {
+		env.index = buildSeriesIndex(env.metrics)
+	}
+	return env.index.resolve(sel, env.instance)
+}
+
+type missingMetricError struct {
+	name string
+}
+
+func (e *missingMetricError) Error() string {
+	return "missing metric: " + e.name
+}
+
+type numberExpr struct {
+	val  float64
+	unit unitKind
+	text string
+}
+
+func (n *numberExpr) Eval(env *evalEnv) (float64, error) { return n.val, nil }
+func (n *numberExpr) String() string                     { return n.text }
+
+// metricExpr selects one series by name and optional label matchers.
+type metricExpr struct {
+	name     string
+	matchers []labelMatcher
+}
+
+func (m *metricExpr) Eval(env *evalEnv) (float64, error) {
+	key, ok := env.resolve(m)
+	if !ok {
+		return 0, &missingMetricError{name: seriesKey(m.String(), env.instance)}
+	}
+	return env.metrics[key], nil
+}
+
+func (m *metricExpr) String() string {
+	if len(m.matchers) == 0 {
+		return m.name
+	}
+	parts := make([]string, len(m.matchers))
+	for i, lm := range m.matchers {
+		parts[i] = lm.String()
+	}
+	return m.name + "{" + strings.Join(parts, ",") + "}"
+}
+
+type unaryExpr struct {
+	op string
+	x  Expr
+}
+
+func (u *unaryExpr) Eval(env *evalEnv) (float64, error) {
+	v, err := u.x.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch u.op {
+	case "-":
+		return -v, nil
+	case "not":
+		return boolFloat(v == 0), nil
+	}
+	return 0, fmt.Errorf("unknown unary operator %s", u.op)
+}
+
+func (u *unaryExpr) String() string {
+	if u.op == "not" {
+		return "not " + u.x.String()
+	}
+	return u.op + u.x.String()
+}
+
+type binaryExpr struct {
+	op   string
+	l, r Expr
+}
+
+func (b *binaryExpr) Eval(env *evalEnv) (float64, error) {
+	l, err := b.l.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	// Short-circuit so "metric_a > 1 or metric_b > 1" works while one is absent.
+	switch b.op {
+	case "and":
+		if l == 0 {
+			return 0, nil
+		}
+	case "or":
+		if l != 0 {
+			return 1, nil
+		}
+	}
+
+	r, err := b.r.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch b.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		return l / r, nil
+	case "%":
+		return math.Mod(l, r), nil
+	case ">":
+		return boolFloat(l > r), nil
+	case "<":
+		return boolFloat(l < r), nil
+	case ">=":
+		return boolFloat(l >= r), nil
+	case "<=":
+		return boolFloat(l <= r), nil
+	case "==":
+		return boolFloat(l == r), nil
+	case "!=":
+		return boolFloat(l != r), nil
+	case "and", "or":
+		return boolFloat(r != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", b.op)
+}
+
+func (b *binaryExpr) String() string {
+	return "(" + b.l.String() + " " + b.op + " " + b.r.String() + ")"
+}
+
+type callExpr struct {
+	name string
+	fn   exprFunc
+	args []Expr
+}
+
+func (c *callExpr) Eval(env *evalEnv) (float64, error) {
+	vals := make([]float64, len(c.args))
+	for i, a := range c.args {
+		v, err := a.Eval(env)
+		if err != nil {
+			return 0, err
+		}
+		vals[i] = v
+	}
+	return c.fn.call(vals), nil
+}
+
+func (c *callExpr) String() string {
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		args[i] = a.String()
+	}
+	return c.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// absentExpr is absent(selector): 1 while no series matching selector
+// carries the instance's labels, 0 otherwise. Because absence has no
+// series of its own, an instance whose series vanish keeps being evaluated
+// for rules that use it.
+type absentExpr struct {
+	sel *metricExpr
+}
+
+func (a *absentExpr) Eval(env *evalEnv) (float64, error) {
+	if env.index == nil {
+		env.index = buildSeriesIndex(env.metrics)
+	}
+	for _, s := range env.index.selectSeries(a.sel.name, a.sel.matchers) {
+		if env.instance.subsetOf(s.labels) {
+			return 0, nil
+		}
+	}
+	return 1, nil
+}
+
+func (a *absentExpr) String() string {
+	return "absent(" + a.sel.String() + ")"
+}
+
+// exprSelectors appends every metric selector in e to out.
+func exprSelectors(e Expr, out *[]*metricExpr) {
+	switch n := e.(type) {
+	case *metricExpr:
+		*out = append(*out, n)
+	case *unaryExpr:
+		exprSelectors(n.x, out)
+	case *binaryExpr:
+		exprSelectors(n.l, out)
+		exprSelectors(n.r, out)
+	case *callExpr:
+		for _, a := range n.args {
+			exprSelectors(a, out)
+		}
+	case *rangeCallExpr:
+		*out = append(*out, n.sel)
+		for _, a := range n.args {
+			exprSelectors(a, out)
+		}
+	case *absentExpr:
+		*out = append(*out, n.sel)
+	case *anomalyExpr:
+		*out = append(*out, n.sel)
+	}
+}
+
+// exprUsesAbsent reports whether e contains absent().
+func exprUsesAbsent(e Expr) bool {
+	switch n := e.(type) {
+	case *absentExpr:
+		return true
+	case *unaryExpr:
+		return exprUsesAbsent(n.x)
+	case *binaryExpr:
+		return exprUsesAbsent(n.l) || exprUsesAbsent(n.r)
+	case *callExpr:
+		for _, a := range n.args {
+			if exprUsesAbsent(a) {
+				return true
+			}
+		}
+	case *rangeCallExpr:
+		for _, a := range n.args {
+			if exprUsesAbsent(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exprUnit returns the unit of e's value and rejects comparisons and sums
+// of incompatible units, such as memory > 80% or cpu > 5GiB. Products and
+// quotients are plain numbers, so memory / memory.total * 100 > 85 passes.
+func exprUnit(e Expr) (unitKind, error) {
+	switch n := e.(type) {
+	case *numberExpr:
+		return n.unit, nil
+	case *metricExpr:
+		return metricUnit(n.name), nil
+	case *absentExpr, *anomalyExpr:
+		return unitAny, nil
+	case *unaryExpr:
+		k, err := exprUnit(n.x)
+		if n.op == "not" {
+			return unitAny, err
+		}
+		return k, err
+	case *binaryExpr:
+		l, err := exprUnit(n.l)
+		if err != nil {
+			return unitAny, err
+		}
+		r, err := exprUnit(n.r)
+		if err != nil {
+			return unitAny, err
+		}
+		switch n.op {
+		case "*", "/", "and", "or":
+			return unitAny, nil
+		case "%":
+			return l, nil
+		}
+		if !l.compatible(r) {
+			return unitAny, fmt.Errorf("cannot use %s (%s) with %s (%s)", n.l, l, n.r, r)
+		}
+		if n.op == "+" || n.op == "-" {
+			if l == unitAny {
+				return r, nil
+			}
+			return l, nil
+		}
+		return unitAny, nil
+	case *callExpr:
+		kind := unitAny
+		for _, a := range n.args {
+			k, err := exprUnit(a)
+			if err != nil {
+				return unitAny, err
+			}
+			if !kind.compatible(k) {
+				return unitAny, fmt.Errorf("%s mixes %s and %s", n, kind, k)
+			}
+			if kind == unitAny {
+				kind = k
+			}
+		}
+		return kind, nil
+	case *rangeCallExpr:
+		for _, a := range n.args {
+			if _, err := exprUnit(a); err != nil {
+				return unitAny, err
+			}
+		}
+		// rate() of bytes is bytes per second, which the byte and bit rate
+		// units already express.
+		return metricUnit(n.sel.name), nil
+	}
+	return unitAny, nil
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ---------------- FUNCTIONS ----------------
+
+type exprFunc struct {
+	minArgs int
+	maxArgs int // -1 for variadic
+	call    func(args []float64) float64
+}
+
+var exprFuncs = map[string]exprFunc{
+	"abs": {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"min": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	"max": {1, -1, func(a []float64) float64 {
+		m := a[0]
+		for _, v := range a[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+}
+
+// ---------------- PARSER ----------------
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// parseExpr compiles a condition string into an Expr.
+func parseExpr(src string) (Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{toks: toks}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.text)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is one of the given operators or
+// word operators (case-insensitive) and returns its canonical form.
+func (p *parser) keyword(words ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokIdent {
+		return "", false
+	}
+	for _, w := range words {
+		if t.kind == tokOp && t.text == w {
+			return w, true
+		}
+		if t.kind == tokIdent && strings.EqualFold(t.text, w) {
+			return strings.ToLower(w), true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.keyword("or", "||"); !ok {
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: "or", l: l, r: r}
+	}
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.keyword("and", "&&"); !ok {
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: "and", l: l, r: r}
+	}
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if _, ok := p.keyword("not", "!"); ok {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: "not", x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	l, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.keyword(">=", "<=", "==", "!=", ">", "<")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) parseAdditive() (Expr, error) {
+	l, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.keyword("+", "-")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) parseMultiplicative() (Expr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.keyword("*", "/", "%")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if op, ok := p.keyword("-", "+"); ok {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return x, nil
+		}
+		return &unaryExpr{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &numberExpr{val: t.num, unit: t.unit, text: t.text}, nil
+
+	case tokLParen:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, fmt.Errorf("at %d: expected ')'", c.pos)
+		}
+		return e, nil
+
+	case tokIdent:
+		switch strings.ToLower(t.text) {
+		case "and", "or", "not":
+			return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.text)
+		}
+		if p.peek().kind == tokLParen {
+			return p.parseCall(t)
+		}
+		return &metricExpr{name: t.text, matchers: t.matchers}, nil
+	}
+
+	if t.kind == tokEOF {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.text)
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	if rf, ok := rangeFuncs[strings.ToLower(name.text)]; ok {
+		return p.parseRangeCall(name, rf)
+	}
+	if strings.EqualFold(name.text, "absent") {
+		return p.parseAbsent(name)
+	}
+	if _, ok := anomalyFuncs[strings.ToLower(name.text)]; ok {
+		return p.parseAnomaly(name)
+	}
+
+	fn, ok := exprFuncs[strings.ToLower(name.text)]
+	if !ok {
+		return nil, fmt.Errorf("at %d: unknown function %s", name.pos, name.text)
+	}
+	p.next() // (
+
+	var args []Expr
+	if p.peek().kind != tokRParen {
+		for {
+			a, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return nil, fmt.Errorf("at %d: expected ')' after arguments to %s", c.pos, name.text)
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("at %d: wrong number of arguments to %s", name.pos, name.text)
+	}
+	return &callExpr{name: strings.ToLower(name.text), fn: fn, args: args}, nil
+}
+
+func (p *parser) parseAbsent(name token) (Expr, error) {
+	p.next() // (
+
+	m := p.next()
+	if m.kind != tokIdent {
+		return nil, fmt.Errorf("at %d: absent expects a metric, e.g. absent(cpu{host=\"web1\"})", m.pos)
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return nil, fmt.Errorf("at %d: expected ')' after argument to %s", c.pos, name.text)
+	}
+	return &absentExpr{sel: &metricExpr{name: m.text, matchers: m.matchers}}, nil
+}
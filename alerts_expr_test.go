@@ -0,0 +1,209 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string // token texts, without EOF
+	}{
+		{"cpu>=90", []string{"cpu", ">=", "90"}},
+		{"memory.total * 0.5", []string{"memory.total", "*", "0.5"}},
+		{"disk./.used_pct > 90", []string{"disk./.used_pct", ">", "90"}},
+		{"disk./var/lib-docker.used_pct", []string{"disk./var/lib-docker.used_pct"}},
+		{"disk./var.used / 2", []string{"disk./var.used", "/", "2"}},
+		{"memory/memory.total", []string{"memory", "/", "memory.total"}},
+		{"net.rx_bytes[5m]", []string{"net.rx_bytes", "5m"}},
+		{"net.rx_bytes[0.25d]", []string{"net.rx_bytes", "0.25d"}},
+		{`disk.used_pct{mount="/var"}`, []string{"disk.used_pct"}},
+		{"a && !b || c", []string{"a", "&&", "!", "b", "||", "c"}},
+		{".5GiB", []string{".5GiB"}},
+		{"1e6 + 2.5E-3", []string{"1e6", "+", "2.5E-3"}},
+		{"1.5e3MB", []string{"1.5e3MB"}},
+	}
+	for _, tt := range tests {
+		toks, err := lex(tt.src)
+		if err != nil {
+			t.Errorf("lex(%q): %v", tt.src, err)
+			continue
+		}
+		var got []string
+		for _, tok := range toks {
+			if tok.kind != tokEOF {
+				got = append(got, tok.text)
+			}
+		}
+		if strings.Join(got, " | ") != strings.Join(tt.want, " | ") {
+			t.Errorf("lex(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"10 - 4 - 3", "((10 - 4) - 3)"},
+		{"memory / memory.total * 100 > 85", "(((memory / memory.total) * 100) > 85)"},
+		{"-cpu * 2", "(-cpu * 2)"},
+		{"a or b and c", "(a or (b and c))"},
+		{"a || b && c", "(a or (b and c))"},
+		{"a > 1 AND b < 2", "((a > 1) and (b < 2))"},
+		{"not a > 1 and b", "(not (a > 1) and b)"},
+		{"!a or b", "(not a or b)"},
+		{"not not a", "not not a"},
+		{"cpu > 2 and not (load1 < 1)", "((cpu > 2) and not (load1 < 1))"},
+		{"max(a, b + 1) >= 90", "(max(a, (b + 1)) >= 90)"},
+		{`disk.used_pct{mount=~"/var.*"} > 90`, `(disk.used_pct{mount=~"/var.*"} > 90)`},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		if got := e.String(); got != tt.want {
+			t.Errorf("parseExpr(%q) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	metrics := map[string]float64{
+		"cpu":                      4,
+		"load1":                    0.5,
+		"memory":                   3 << 30,
+		"memory.total":             4 << 30,
+		"disk./.used_pct":          91,
+		"disk./var/lib-x.used":     10,
+		`disk.used_pct{mount="/"}`: 91,
+	}
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"cpu > 2 and not (load1 < 1)", 0},
+		{"cpu > 2 and not load1 > 1", 1},
+		{"memory / memory.total * 100", 75},
+		{"memory > 2GiB", 1},
+		{"memory > 4GB", 0},
+		{"disk./.used_pct >= 90", 1},
+		{"disk./var/lib-x.used / 2", 5},
+		{"7 % 4", 3},
+		{"-cpu + 10", 6},
+		{"max(cpu, load1, 2)", 4},
+		{"cpu > 1 or missing > 1", 1},
+		{"cpu < 1 and missing > 1", 0},
+		{"1.5k", 1500},
+		{"2M", 2e6},
+		{"5m", 300},
+		{"250ms", 0.25},
+		{"8Mbit", 1e6},
+		{"1KiB + 1kB", 2024},
+		{"1e6", 1e6},
+		{"2.5E-3", 0.0025},
+		{"1.5e3MB", 1.5e9},
+		{"1e+2s", 100},
+		{"50%", 50},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.Eval(&evalEnv{metrics: metrics})
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	e, _ := parseExpr("missing > 1")
+	if _, err := e.Eval(&evalEnv{metrics: metrics}); err == nil {
+		t.Error("missing metric evaluated without error")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"cpu >",
+		"(cpu > 1",
+		"cpu > 1)",
+		"and cpu",
+		"cpu > 5xyz",
+		"net.rx > 10Mb",
+		"net.rx > 10Kb",
+		"net.rx > 1kb",
+		"net.rx > 1b",
+		"net.rx > 2mib",
+		"cpu > 1e",
+		"cpu > 1e+",
+		"cpu $ 1",
+		"cpu. > 1",
+		"nosuchfunc(cpu)",
+		"rate(cpu[5m",
+		"rate(cpu[-1d]) > 1",
+		"rate(cpu[0d]) > 1",
+		"rate(cpu[-5m]) > 1",
+		"rate(cpu[NaNd]) > 1",
+		"rate(cpu[1e300d]) > 1",
+		`disk.used_pct{mount="/"`,
+	} {
+		if e, err := parseExpr(src); err == nil {
+			t.Errorf("parseExpr(%q) = %s, want an error", src, e)
+		}
+	}
+}
+
+func TestExprUnits(t *testing.T) {
+	tests := []struct {
+		src string
+		ok  bool
+	}{
+		{"memory > 2GiB", true},
+		{"memory > 80%", false},
+		{"cpu > 5GiB", false},
+		{"disk./.used_pct > 90%", true},
+		{"memory / memory.total * 100 > 85", true},
+		{"memory + 1GiB > memory.total", true},
+		{"memory + 5s > 1", false},
+		{"max(memory, 1GiB) > 0", true},
+		{"max(memory, 50%) > 0", false},
+		{"rate(net.rx_bytes[1m]) > 80Mbps", true},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		if _, err := exprUnit(e); (err == nil) != tt.ok {
+			t.Errorf("exprUnit(%q) error = %v, want ok %v", tt.src, err, tt.ok)
+		}
+	}
+}
+
+func TestAmbiguousByteUnits(t *testing.T) {
+	for _, q := range []string{"10Mb", "1kb", "3Gb", "1b"} {
+		if _, _, err := parseWithUnits(q); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+			t.Errorf("parseWithUnits(%q) error = %v, want ambiguous", q, err)
+		}
+	}
+	for _, q := range []string{"10MB", "1kB", "3GiB", "1B", "8Mbit", "10Mbps"} {
+		if _, _, err := parseWithUnits(q); err != nil {
+			t.Errorf("parseWithUnits(%q): %v", q, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// ---------------- ALERT HISTORY ----------------
+
+// HistoryConfig selects the database alert transitions are written to:
+//
+//	history:
+//	  driver: sqlite          # or postgres
+//	  dsn: alerts.db
+type HistoryConfig struct {
+	Driver string `mapstructure:"driver"`
+	DSN    string `mapstructure:"dsn"`
+}
+
+// AlertTransition is one state change of one alert.
+type AlertTransition struct {
+	ID          uint               `gorm:"primaryKey" json:"id"`
+	Alert       string             `gorm:"index" json:"alert"`
+	State       AlertState         `gorm:"index" json:"state"`
+	Previous    AlertState         `json:"previous"`
+	Severity    string             `json:"severity,omitempty"`
+	Labels      map[string]string  `gorm:"serializer:json" json:"labels,omitempty"`
+	Message     string             `json:"message,omitempty"`
+	Values      map[string]float64 `gorm:"serializer:json" json:"values,omitempty"`
+	Rule        string             `json:"rule"`
+	SilencedBy  string             `json:"silenced_by,omitempty"`
+	InhibitedBy string             `json:"inhibited_by,omitempty"`
+	StartedAt   time.Time          `json:"started_at"`
+	EndedAt     *time.Time         `json:"ended_at,omitempty"`
+	Time        time.Time          `gorm:"index" json:"time"`
+}
+
+func newAlertTransition(e AlertEvent) AlertTransition {
+	return AlertTransition{
+		Alert:       e.Alert,
+		State:       e.State,
+		Previous:    e.Previous,
+		Severity:    e.Severity,
+		Labels:      e.Labels,
+		Message:     e.Message,
+		Values:      e.Values,
+		Rule:        e.Rule,
+		SilencedBy:  e.SilencedBy,
+		InhibitedBy: e.InhibitedBy,
+		StartedAt:   e.ActiveAt,
+		EndedAt:     timePtr(e.ResolvedAt),
+		Time:        e.Time,
+	}
+}
+
+// HistoryStore writes transitions in the background so a slow database
+// never stalls evaluation.
+type HistoryStore struct {
+	db    *gorm.DB
+	queue chan AlertTransition
+}
+
+// openDatabase connects to a sqlite or postgres database.
+func openDatabase(driver, dsn string) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "sqlite":
+		dialector = sqlite.Open(dsn)
+	case "postgres":
+		dialector = postgres.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unknown driver %q", driver)
+	}
+	return gorm.Open(dialector, &gorm.Config{})
+}
+
+func OpenHistory(cfg HistoryConfig) (*HistoryStore, error) {
+	db, err := openDatabase(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&AlertTransition{}); err != nil {
+		return nil, err
+	}
+
+	h := &HistoryStore{db: db, queue: make(chan AlertTransition, 1024)}
+	go h.run()
+	return h, nil
+}
+
+func (h *HistoryStore) run() {
+	for t := range h.queue {
+		if err := h.db.Create(&t).Error; err != nil {
+			log.Printf("history: store %s %s: %v", t.Alert, t.State, err)
+		}
+	}
+}
+
+// Record queues e for storage. It drops the event rather than block when the
+// database has fallen far behind.
+func (h *HistoryStore) Record(e AlertEvent) {
+	select {
+	case h.queue <- newAlertTransition(e):
+	default:
+		log.Printf("history: queue full, dropping %s %s", e.Alert, e.State)
+	}
+}
+
+// HistoryQuery filters stored transitions. Zero fields match everything.
+type HistoryQuery struct {
+	Alert string
+	State AlertState
+	From  time.Time
+	To    time.Time
+	Limit int
+}
+
+func (h *HistoryStore) Query(q HistoryQuery) ([]AlertTransition, error) {
+	db := h.db
+	if q.Alert != "" {
+		db = db.Where("alert = ?", q.Alert)
+	}
+	if q.State != "" {
+		db = db.Where("state = ?", q.State)
+	}
+	if !q.From.IsZero() {
+		db = db.Where("time >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		db = db.Where("time <= ?", q.To)
+	}
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 1000
+	}
+
+	var out []AlertTransition
+	err := db.Order("time desc").Limit(q.Limit).Find(&out).Error
+	return out, err
+}
+
+// ServeHTTP answers GET /api/alerts/history?alert=&state=&from=&to=&limit=
+// with times in RFC 3339.
+func (h *HistoryStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	q := HistoryQuery{
+		Alert: params.Get("alert"),
+		State: AlertState(params.Get("state")),
+	}
+
+	var err error
+	if q.From, err = parseTimeParam(params.Get("from")); err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseTimeParam(params.Get("to")); err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s := params.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := h.Query(q)
+	if err != nil {
+		http.Error(w, "Failed to query history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
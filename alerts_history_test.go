@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// awaitHistory waits until the store's background writer has stored n rows.
+func awaitHistory(t *testing.T, h *HistoryStore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows, err := h.Query(HistoryQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history has %d rows, want %d", len(rows), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHistoryPersistsTransitions(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "alerts.db")
+	h, err := OpenHistory(HistoryConfig{Driver: "sqlite", DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	events := []AlertEvent{
+		{Alert: "cpu_high", State: StatePending, Previous: StateInactive, Time: start},
+		{Alert: "cpu_high", State: StateFiring, Previous: StatePending, Values: map[string]float64{"cpu": 3}, Time: start.Add(time.Minute)},
+		{Alert: "disk_full", State: StateFiring, Previous: StateInactive, Time: start.Add(2 * time.Minute)},
+		{Alert: "cpu_high", State: StateResolved, Previous: StateFiring, ResolvedAt: start.Add(3 * time.Minute), Time: start.Add(3 * time.Minute)},
+	}
+	for _, e := range events {
+		h.Record(e)
+	}
+	awaitHistory(t, h, len(events))
+
+	// A second store over the same file sees what the first one wrote.
+	reopened, err := OpenHistory(HistoryConfig{Driver: "sqlite", DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := reopened.Query(HistoryQuery{Alert: "cpu_high"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].State != StateResolved || rows[2].State != StatePending {
+		t.Fatalf("cpu_high rows = %+v, want 3 newest first", rows)
+	}
+	if rows[0].EndedAt == nil || !rows[0].EndedAt.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("resolved row ended_at = %v", rows[0].EndedAt)
+	}
+	if rows[1].Values["cpu"] != 3 {
+		t.Errorf("firing row values = %v, want cpu 3", rows[1].Values)
+	}
+
+	tests := []struct {
+		name string
+		q    HistoryQuery
+		want int
+	}{
+		{"all", HistoryQuery{}, 4},
+		{"state", HistoryQuery{State: StateFiring}, 2},
+		{"alert and state", HistoryQuery{Alert: "cpu_high", State: StateFiring}, 1},
+		{"from", HistoryQuery{From: start.Add(2 * time.Minute)}, 2},
+		{"to", HistoryQuery{To: start.Add(time.Minute)}, 2},
+		{"window", HistoryQuery{From: start.Add(time.Minute), To: start.Add(2 * time.Minute)}, 2},
+		{"limit", HistoryQuery{Limit: 1}, 1},
+		{"no match", HistoryQuery{Alert: "nope"}, 0},
+	}
+	for _, tt := range tests {
+		rows, err := reopened.Query(tt.q)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(rows) != tt.want {
+			t.Errorf("%s: %d rows, want %d", tt.name, len(rows), tt.want)
+		}
+	}
+}
+
+func TestHistoryHTTP(t *testing.T) {
+	h, err := OpenHistory(HistoryConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "alerts.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	for i, state := range []AlertState{StatePending, StateFiring, StateResolved} {
+		h.Record(AlertEvent{Alert: "cpu_high", State: state, Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	awaitHistory(t, h, 3)
+
+	tests := []struct {
+		query  string
+		status int
+		rows   int
+	}{
+		{"", http.StatusOK, 3},
+		{"?alert=cpu_high&state=firing", http.StatusOK, 1},
+		{"?from=2026-01-02T03:01:00Z&limit=1", http.StatusOK, 1},
+		{"?to=2026-01-02T03:00:30Z", http.StatusOK, 1},
+		{"?from=yesterday", http.StatusBadRequest, 0},
+		{"?limit=ten", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/alerts/history"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var rows []AlertTransition
+		if err := json.Unmarshal(rec.Body.Bytes(), &rows); err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+		} else if len(rows) != tt.rows {
+			t.Errorf("%s: %d rows, want %d", tt.query, len(rows), tt.rows)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/alerts/history", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ---------------- WEBSOCKET HUB ----------------
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 4096
+	sendBuffer     = 256
+)
+
+// Hub owns the set of connected clients. Only Run touches the client map;
+// everything else talks to it through channels. Every broadcast is also
+// kept in replay for SSE and long-poll clients.
+type Hub struct {
+	clients    map[*Client]bool
+	broadcast  chan AlertEvent
+	register   chan *Client
+	unregister chan *Client
+	upgrader   websocket.Upgrader
+	replay     *replayBuffer
+	count      int64 // len(clients), readable outside Run
+}
+
+// NewHub returns a hub whose upgrader accepts origins approved by
+// checkOrigin.
+func NewHub(checkOrigin func(*http.Request) bool) *Hub {
+	return &Hub{
+		clients:    make(map[*Client]bool),
+		broadcast:  make(chan AlertEvent, 64),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     checkOrigin,
+		},
+		replay: newReplayBuffer(),
+	}
+}
+
+// Client is one WebSocket connection. send is closed by the hub when the
+// client is dropped; replies carries protocol answers from the read pump
+// and is never closed. grants, fixed at connect time from the client's
+// token, bound what its subscriptions can see.
+type Client struct {
+	hub     *Hub
+	conn    *websocket.Conn
+	send    chan []byte
+	replies chan []byte
+	grants  []alertGrant
+	expiry  *time.Timer // closes the connection when its token expires
+
+	mu         sync.Mutex
+	subs       []Subscription
+	subscribed bool // once set, an empty subs matches nothing
+}
+
+// Run processes registrations and broadcasts until the process exits.
+func (h *Hub) Run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+			atomic.StoreInt64(&h.count, int64(len(h.clients)))
+
+		case c := <-h.unregister:
+			h.drop(c)
+
+		case event := <-h.broadcast:
+			h.replay.append(event)
+			msg, err := encodeAlertMessage(event)
+			if err != nil {
+				log.Printf("encode %s: %v", event.Alert, err)
+				continue
+			}
+			for c := range h.clients {
+				if !c.wants(event) {
+					continue
+				}
+				select {
+				case c.send <- msg:
+				default:
+					// Too slow to keep up; its write pump will close the socket.
+					h.drop(c)
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) drop(c *Client) {
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+		atomic.StoreInt64(&h.count, int64(len(h.clients)))
+	}
+}
+
+// ClientCount returns the number of connected clients.
+func (h *Hub) ClientCount() int64 {
+	return atomic.LoadInt64(&h.count)
+}
+
+// Broadcast queues e for every subscribed client.
+func (h *Hub) Broadcast(e AlertEvent) {
+	h.broadcast <- e
+}
+
+// ServeWS upgrades the request and starts the client's pumps. It must be
+// mounted behind Authenticator.Require; the connection is closed when the
+// client's token expires.
+func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
+	acc := accessFrom(r.Context())
+	if acc == nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return
+	}
+	grants, err := acc.alertGrants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error to w.
+		log.Printf("websocket upgrade from %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	c := &Client{
+		hub:     h,
+		conn:    conn,
+		send:    make(chan []byte, sendBuffer),
+		replies: make(chan []byte, 16),
+		grants:  grants,
+	}
+	h.register <- c
+
+	if !acc.Expires.IsZero() {
+		c.expiry = time.AfterFunc(time.Until(acc.Expires), func() {
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			conn.Close()
+		})
+	}
+
+	go c.writePump()
+	go c.readPump()
+}
+
+// readPump handles client frames and pongs. A read error or missed pong
+// unregisters the client.
+func (c *Client) readPump() {
+	defer func() {
+		if c.expiry != nil {
+			c.expiry.Stop()
+		}
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket %s: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if reply := c.handleMessage(data); reply != nil {
+			select {
+			case c.replies <- reply:
+			default:
+			}
+		}
+	}
+}
+
+// writePump is the only writer on the connection. It exits, closing the
+// socket, once the hub closes send or a write fails.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+
+		case msg := <-c.replies:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startHub serves a running hub on /ws as a client holding acc.
+func startHub(t *testing.T, acc *Access) (*Hub, string) {
+	t.Helper()
+	hub := NewHub(func(*http.Request) bool { return true })
+	go hub.Run()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.ServeWS(w, r.WithContext(context.WithValue(r.Context(), accessKey{}, acc)))
+	}))
+	t.Cleanup(srv.Close)
+	return hub, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialHub(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+func readServerMessage(conn *websocket.Conn) (serverMessage, error) {
+	var msg serverMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return msg, err
+	}
+	return msg, json.Unmarshal(data, &msg)
+}
+
+func subscribe(conn *websocket.Conn, alerts ...string) error {
+	data, _ := json.Marshal(clientMessage{Version: protocolVersion, Type: "subscribe", Subscription: Subscription{Alerts: alerts}})
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// awaitClients waits until the hub has n clients registered.
+func awaitClients(t *testing.T, hub *Hub, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.ClientCount() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has %d clients, want %d", hub.ClientCount(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testEvent(name string, i int) AlertEvent {
+	return AlertEvent{
+		Alert:    name,
+		Labels:   map[string]string{"alertname": name, "seq": fmt.Sprint(i)},
+		State:    StateFiring,
+		Previous: StatePending,
+		Time:     time.Now(),
+	}
+}
+
+func TestHubSubscriptionFilters(t *testing.T) {
+	hub, url := startHub(t, &Access{})
+	conn := dialHub(t, url)
+	defer conn.Close()
+
+	if err := subscribe(conn, "disk_full"); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readServerMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "subscriptions" || len(msg.Subscriptions) != 1 {
+		t.Fatalf("reply = %+v, want one subscription", msg)
+	}
+
+	hub.Broadcast(testEvent("cpu_high", 0))
+	hub.Broadcast(testEvent("disk_full", 1))
+	msg, err = readServerMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "alert" || msg.Alert.Name != "disk_full" {
+		t.Fatalf("got %+v, want the disk_full alert only", msg)
+	}
+}
+
+func TestHubUnsubscribeAll(t *testing.T) {
+	hub, url := startHub(t, &Access{})
+	conn := dialHub(t, url)
+	defer conn.Close()
+
+	expectSubscriptions := func(n int) {
+		t.Helper()
+		msg, err := readServerMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "subscriptions" || len(msg.Subscriptions) != n {
+			t.Fatalf("reply = %+v, want %d subscriptions", msg, n)
+		}
+	}
+	if err := subscribe(conn, "disk_full"); err != nil {
+		t.Fatal(err)
+	}
+	expectSubscriptions(1)
+	data, _ := json.Marshal(clientMessage{Version: protocolVersion, Type: "unsubscribe", Subscription: Subscription{Alerts: []string{"disk_full"}}})
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	expectSubscriptions(0)
+
+	// Nothing is subscribed any more: not even disk_full gets through.
+	hub.Broadcast(testEvent("disk_full", 0))
+	if err := subscribe(conn, "cpu_high"); err != nil {
+		t.Fatal(err)
+	}
+	expectSubscriptions(1)
+	hub.Broadcast(testEvent("cpu_high", 1))
+	msg, err := readServerMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "alert" || msg.Alert.Name != "cpu_high" {
+		t.Fatalf("got %+v, want the cpu_high alert only", msg)
+	}
+}
+
+func TestHubConcurrentClients(t *testing.T) {
+	hub, url := startHub(t, &Access{})
+
+	stop := make(chan struct{})
+	var broadcasts sync.WaitGroup
+	broadcasts.Add(1)
+	go func() {
+		defer broadcasts.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			name := "cpu_high"
+			if i%2 == 0 {
+				name = "disk_full"
+			}
+			hub.Broadcast(testEvent(name, i))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const clients = 50
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			switch i % 3 {
+			case 0:
+				// Drop straight away, possibly mid-broadcast.
+				return
+			case 1:
+				if err := subscribe(conn, "disk_full"); err != nil {
+					errs <- err
+					return
+				}
+			}
+			// Read a few frames, then leave without a close handshake.
+			for n := rand.Intn(20) + 1; n > 0; n-- {
+				if _, err := readServerMessage(conn); err != nil {
+					errs <- fmt.Errorf("client %d: %v", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	broadcasts.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	awaitClients(t, hub, 0)
+}
+
+func TestHubClosesOnTokenExpiry(t *testing.T) {
+	hub, url := startHub(t, &Access{Expires: time.Now().Add(200 * time.Millisecond)})
+	conn := dialHub(t, url)
+	defer conn.Close()
+
+	for {
+		_, err := readServerMessage(conn)
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("read: %v, want a policy violation close", err)
+		}
+		break
+	}
+	awaitClients(t, hub, 0)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ---------------- INHIBITION ----------------
+
+// InhibitRule mutes alerts matching Target while an alert matching Source
+// is firing with the same values for every label in Equal. Like silences,
+// inhibited alerts are still evaluated and recorded.
+//
+//	inhibit_rules:
+//	  - source: {alert: host_down}
+//	    equal: [host]
+//	  - source: {labels: {severity: critical}}
+//	    target: {labels: {severity: warning}}
+//	    equal: [host]
+type InhibitRule struct {
+	Source AlertMatcher `mapstructure:"source"`
+	Target AlertMatcher `mapstructure:"target"`
+	Equal  []string     `mapstructure:"equal"`
+}
+
+// AlertMatcher selects alerts by name and/or labels. Empty fields match
+// everything.
+type AlertMatcher struct {
+	Alert  string            `mapstructure:"alert"`
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+func (m AlertMatcher) matches(name string, labels map[string]string) bool {
+	if m.Alert != "" && m.Alert != name && m.Alert != labels["alertname"] {
+		return false
+	}
+	for k, v := range m.Labels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (m AlertMatcher) empty() bool {
+	return m.Alert == "" && len(m.Labels) == 0
+}
+
+func validateInhibitRules(rules []InhibitRule, errs *ConfigError) {
+	for i, r := range rules {
+		if r.Source.empty() {
+			errs.add(fmt.Sprintf("inhibit_rules[%d].source", i), "alert or labels is required")
+		}
+	}
+}
+
+// inhibitedBy returns the name of a firing alert in active that inhibits e
+// under rules, or "". An alert never inhibits itself.
+func inhibitedBy(rules []InhibitRule, e AlertEvent, active []ActiveAlert) string {
+	for _, r := range rules {
+		if !r.Target.matches(e.Alert, e.Labels) {
+			continue
+		}
+		var sources []string
+		for _, a := range active {
+			if a.State != StateFiring || a.Instance == e.Instance {
+				continue
+			}
+			if !r.Source.matches(a.Name, a.Labels) || !equalLabels(r.Equal, a.Labels, e.Labels) {
+				continue
+			}
+			sources = append(sources, a.Name+a.Labels.Key())
+		}
+		if len(sources) > 0 {
+			// Report the same source on every tick regardless of map order.
+			sort.Strings(sources)
+			return sources[0]
+		}
+	}
+	return ""
+}
+
+// equalLabels reports whether a and b agree on every name. A label missing
+// from both counts as equal.
+func equalLabels(names []string, a, b map[string]string) bool {
+	for _, name := range names {
+		if a[name] != b[name] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInhibitedBy(t *testing.T) {
+	rules := []InhibitRule{
+		{Source: AlertMatcher{Alert: "host_down"}, Equal: []string{"host"}},
+		{
+			Source: AlertMatcher{Labels: map[string]string{"severity": "critical"}},
+			Target: AlertMatcher{Labels: map[string]string{"severity": "warning"}},
+			Equal:  []string{"host"},
+		},
+	}
+	active := []ActiveAlert{
+		{Name: "host_down", Instance: instanceKey("host_down", Labels{"host": "a"}), Labels: Labels{"alertname": "host_down", "host": "a"}, State: StateFiring},
+		{Name: "host_down", Instance: instanceKey("host_down", Labels{"host": "p"}), Labels: Labels{"alertname": "host_down", "host": "p"}, State: StatePending},
+		{Name: "disk_full", Instance: instanceKey("disk_full", Labels{"host": "c"}), Labels: Labels{"alertname": "disk_full", "host": "c", "severity": "critical"}, State: StateFiring},
+	}
+	event := func(name string, labels Labels) AlertEvent {
+		return AlertEvent{Alert: name, Instance: instanceKey(name, labels), Labels: labels.Merge(Labels{"alertname": name}), State: StateFiring}
+	}
+
+	tests := []struct {
+		name  string
+		event AlertEvent
+		want  string
+	}{
+		{"same host", event("cpu_high", Labels{"host": "a"}), `host_down{alertname="host_down",host="a"}`},
+		{"other host", event("cpu_high", Labels{"host": "b"}), ""},
+		{"pending source", event("cpu_high", Labels{"host": "p"}), ""},
+		{"never itself", event("host_down", Labels{"host": "a"}), ""},
+		{"warning under critical", event("disk_slow", Labels{"host": "c", "severity": "warning"}), `disk_full{alertname="disk_full",host="c",severity="critical"}`},
+		{"info is not a target", event("disk_slow", Labels{"host": "c", "severity": "info"}), ""},
+	}
+	for _, tt := range tests {
+		if got := inhibitedBy(rules, tt.event, active); got != tt.want {
+			t.Errorf("%s: inhibited by %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileSeverityAndInhibitRules(t *testing.T) {
+	cfg := Config{
+		Alerts:  []Alert{{Name: "cpu_high", Severity: "page", Rule: Rule{Condition: "cpu > 2"}}},
+		Inhibit: []InhibitRule{{Target: AlertMatcher{Alert: "cpu_high"}}},
+	}
+	err := compileConfig(&cfg)
+	if err == nil {
+		t.Fatal("compileConfig accepted an unknown severity and an empty inhibit source")
+	}
+	for _, path := range []string{"alerts[0].severity", "inhibit_rules[0].source"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("error %q does not mention %s", err, path)
+		}
+	}
+
+	cfg.Alerts[0].Severity = "critical"
+	cfg.Inhibit[0].Source = AlertMatcher{Alert: "host_down"}
+	if err := compileConfig(&cfg); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+}
+
+func TestHeldAlertsReleasedWhenSourceResolves(t *testing.T) {
+	rules := []InhibitRule{{Source: AlertMatcher{Alert: "host_down"}, Equal: []string{"host"}}}
+	source := ActiveAlert{Name: "host_down", Instance: instanceKey("host_down", Labels{"host": "a"}), Labels: Labels{"alertname": "host_down", "host": "a"}, State: StateFiring}
+	target := ActiveAlert{Name: "cpu_high", Instance: instanceKey("cpu_high", Labels{"host": "a"}), Labels: Labels{"alertname": "cpu_high", "host": "a"}, State: StateFiring}
+
+	active := []ActiveAlert{source, target}
+	e := AlertEvent{Alert: "cpu_high", Instance: target.Instance, Labels: target.Labels, State: StateFiring, Previous: StatePending}
+	e.InhibitedBy = inhibitedBy(rules, e, active)
+	if e.InhibitedBy == "" {
+		t.Fatal("target not inhibited")
+	}
+
+	held := make(heldAlerts)
+	held.track(e)
+	release := func(active []ActiveAlert) []AlertEvent {
+		return held.release(active, func(e AlertEvent) bool { return inhibitedBy(rules, e, active) != "" })
+	}
+	if got := release(active); len(got) != 0 {
+		t.Errorf("released %v while the source fires", got)
+	}
+	got := release([]ActiveAlert{target})
+	if len(got) != 1 || got[0].Alert != "cpu_high" || got[0].InhibitedBy != "" {
+		t.Errorf("released %+v after the source resolved, want cpu_high", got)
+	}
+}
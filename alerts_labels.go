@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// ---------------- LABELED SERIES ----------------
+//
+// A metric is a series: a name plus an optional label set. Series travel
+// through the flat metrics map under a canonical key,
+//
+//	disk.used_pct{mount="/var"}
+//
+// with labels sorted by name. Unlabeled metrics keep their bare name.
+
+type Labels map[string]string
+
+// Key renders the labels in canonical {k="v",...} form, or "" when empty.
+func (l Labels) Key() string {
+	if len(l) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// subsetOf reports whether every label in l has the same value in o.
+func (l Labels) subsetOf(o Labels) bool {
+	for k, v := range l {
+		if ov, ok := o[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns a copy of l overlaid with o.
+func (l Labels) Merge(o Labels) Labels {
+	out := make(Labels, len(l)+len(o))
+	for k, v := range l {
+		out[k] = v
+	}
+	for k, v := range o {
+		out[k] = v
+	}
+	return out
+}
+
+func seriesKey(name string, labels Labels) string {
+	return name + labels.Key()
+}
+
+// parseSeriesKey splits a key produced by seriesKey.
+func parseSeriesKey(key string) (string, Labels, error) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(key, "}") {
+		return "", nil, fmt.Errorf("malformed series %q", key)
+	}
+	matchers, err := parseMatchers(key[i+1 : len(key)-1])
+	if err != nil {
+		return "", nil, fmt.Errorf("series %q: %v", key, err)
+	}
+	labels := make(Labels, len(matchers))
+	for _, m := range matchers {
+		if m.op != "=" {
+			return "", nil, fmt.Errorf("series %q: only = is allowed", key)
+		}
+		labels[m.name] = m.value
+	}
+	return key[:i], labels, nil
+}
+
+// ---------------- SELECTORS ----------------
+
+// labelMatcher is one term of a selector such as {mount=~"/var.*"}.
+type labelMatcher struct {
+	name  string
+	op    string // =, !=, =~, !~
+	value string
+	re    *regexp.Regexp
+}
+
+func (m labelMatcher) matches(labels Labels) bool {
+	v := labels[m.name]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (m labelMatcher) String() string {
+	return m.name + m.op + strconv.Quote(m.value)
+}
+
+// parseMatchers parses the inside of {...}: comma-separated name op "value".
+func parseMatchers(src string) ([]labelMatcher, error) {
+	var out []labelMatcher
+	i := 0
+	for {
+		for i < len(src) && (src[i] == ' ' || src[i] == ',') {
+			i++
+		}
+		if i >= len(src) {
+			return out, nil
+		}
+
+		start := i
+		for i < len(src) && isIdentChar(src[i]) {
+			i++
+		}
+		name := src[start:i]
+		if name == "" {
+			return nil, fmt.Errorf("expected label name at %q", src[start:])
+		}
+		for i < len(src) && src[i] == ' ' {
+			i++
+		}
+
+		var op string
+		for _, cand := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(src[i:], cand) {
+				op = cand
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("expected =, !=, =~ or !~ after %s", name)
+		}
+		i += len(op)
+		for i < len(src) && src[i] == ' ' {
+			i++
+		}
+
+		if i >= len(src) || src[i] != '"' {
+			return nil, fmt.Errorf("expected quoted value for %s", name)
+		}
+		end := i + 1
+		for end < len(src) && src[end] != '"' {
+			if src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(src) {
+			return nil, fmt.Errorf("unterminated value for %s", name)
+		}
+		value, err := strconv.Unquote(src[i : end+1])
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %v", name, err)
+		}
+		i = end + 1
+
+		m := labelMatcher{name: name, op: op, value: value}
+		if op == "=~" || op == "!~" {
+			if m.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, fmt.Errorf("bad regexp for %s: %v", name, err)
+			}
+		}
+		out = append(out, m)
+	}
+}
+
+// scanBraces returns the index just past the } closing the { at i,
+// skipping over quoted values.
+func scanBraces(src string, i int) (int, error) {
+	inQuote := false
+	for j := i + 1; j < len(src); j++ {
+		switch {
+		case inQuote && src[j] == '\\':
+			j++
+		case src[j] == '"':
+			inQuote = !inQuote
+		case !inQuote && src[j] == '}':
+			return j + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("at %d: unterminated label selector", i)
+}
+
+// ---------------- SERIES INDEX ----------------
+
+type indexedSeries struct {
+	key    string
+	labels Labels
+}
+
+// seriesIndex groups the keys of a metrics map by metric name.
+type seriesIndex map[string][]indexedSeries
+
+func buildSeriesIndex(metrics map[string]float64) seriesIndex {
+	idx := make(seriesIndex)
+	for key := range metrics {
+		name, labels, err := parseSeriesKey(key)
+		if err != nil {
+			continue
+		}
+		idx[name] = append(idx[name], indexedSeries{key: key, labels: labels})
+	}
+	return idx
+}
+
+// selectSeries returns every series named name that satisfies matchers.
+func (idx seriesIndex) selectSeries(name string, matchers []labelMatcher) []indexedSeries {
+	var out []indexedSeries
+	for _, s := range idx[name] {
+		ok := true
+		for _, m := range matchers {
+			if !m.matches(s.labels) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// resolve picks the series for sel within one alert instance: the most
+// specific match whose labels are all carried by the instance. An instance
+// of a pushing agent only resolves to series of that host, never to the
+// server's own unlabeled ones, which describe a different machine.
+func (idx seriesIndex) resolve(sel *metricExpr, instance Labels) (string, bool) {
+	_, hosted := instance["host"]
+	best, bestLabels := "", -1
+	for _, s := range idx.selectSeries(sel.name, sel.matchers) {
+		if _, ok := s.labels["host"]; hosted && !ok {
+			continue
+		}
+		if s.labels.subsetOf(instance) && len(s.labels) > bestLabels {
+			best, bestLabels = s.key, len(s.labels)
+		}
+	}
+	return best, bestLabels >= 0
+}
+
+// instances returns one label set per alert instance the selectors expand
+// to. A rule over unlabeled metrics has a single empty instance. Selectors
+// whose series carry different label names yield separate instances. The
+// server's own unlabeled series keep their empty instance when every other
+// instance belongs to a pushing agent, since resolve never lets those read
+// local series.
+func (idx seriesIndex) instances(sels []*metricExpr) []Labels {
+	seen := make(map[string]bool)
+	var out []Labels
+	unlabeled, local := false, false
+	for _, sel := range sels {
+		for _, s := range idx.selectSeries(sel.name, sel.matchers) {
+			key := s.labels.Key()
+			if key == "" {
+				unlabeled = true
+				continue
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, hosted := s.labels["host"]; !hosted {
+				local = true
+			}
+			out = append(out, s.labels)
+		}
+	}
+	if len(out) == 0 || (unlabeled && !local) {
+		out = append(out, nil)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key() < out[j].Key() })
+	return out
+}
+
+// ---------------- TEMPLATES ----------------
+
+// parseLabelTemplate compiles an alert name or message. Missing labels
+// render as empty strings.
+func parseLabelTemplate(text string) (*template.Template, error) {
+	if !strings.Contains(text, "{{") {
+		return nil, nil
+	}
+	return template.New("").Option("missingkey=zero").Parse(text)
+}
+
+// renderLabelTemplate executes t with labels, falling back to the raw text
+// when there is no template or it fails.
+func renderLabelTemplate(t *template.Template, text string, labels Labels) string {
+	if t == nil {
+		return text
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, map[string]string(labels)); err != nil {
+		return text
+	}
+	return b.String()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeriesKeyRoundTrip(t *testing.T) {
+	labels := Labels{"mount": "/var", "host": `db "1"`}
+	key := seriesKey("disk.used_pct", labels)
+	if want := `disk.used_pct{host="db \"1\"",mount="/var"}`; key != want {
+		t.Fatalf("seriesKey = %s, want %s", key, want)
+	}
+	name, got, err := parseSeriesKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "disk.used_pct" || got.Key() != labels.Key() {
+		t.Errorf("parseSeriesKey = %s %v, want disk.used_pct %v", name, got, labels)
+	}
+	if name, got, _ := parseSeriesKey("cpu"); name != "cpu" || got != nil {
+		t.Errorf("parseSeriesKey(cpu) = %s %v", name, got)
+	}
+	for _, bad := range []string{`cpu{core="0"`, `cpu{core!="0"}`, `cpu{core=0}`} {
+		if _, _, err := parseSeriesKey(bad); err == nil {
+			t.Errorf("parseSeriesKey(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestLabelSelectors(t *testing.T) {
+	metrics := map[string]float64{
+		"disk.used_pct": 50,
+		seriesKey("disk.used_pct", Labels{"mount": "/"}):        91,
+		seriesKey("disk.used_pct", Labels{"mount": "/var"}):     95,
+		seriesKey("disk.used_pct", Labels{"mount": "/var/lib"}): 40,
+		seriesKey("disk.used_pct", Labels{"mount": "/home"}):    10,
+	}
+	idx := buildSeriesIndex(metrics)
+
+	tests := []struct {
+		selector string
+		want     []string // mounts
+	}{
+		{`disk.used_pct{mount="/var"}`, []string{"/var"}},
+		{`disk.used_pct{mount!="/var"}`, []string{"", "/", "/home", "/var/lib"}},
+		{`disk.used_pct{mount=~"/var.*"}`, []string{"/var", "/var/lib"}},
+		{`disk.used_pct{mount!~"/var.*|/home"}`, []string{"", "/"}},
+		{`disk.used_pct{mount=~"var"}`, nil},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.selector)
+		if err != nil {
+			t.Errorf("parseExpr(%s): %v", tt.selector, err)
+			continue
+		}
+		sel := e.(*metricExpr)
+		var got []string
+		for _, s := range idx.selectSeries(sel.name, sel.matchers) {
+			got = append(got, s.labels["mount"])
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s selects %q, want %q", tt.selector, got, tt.want)
+		}
+	}
+
+	if _, err := parseExpr(`disk.used_pct{mount=~"("}`); err == nil {
+		t.Error("invalid regular expression accepted")
+	}
+}
+
+func TestPerSeriesAlerts(t *testing.T) {
+	cfg := Config{Alerts: []Alert{{
+		Name:    "disk_full_{{.mount}}",
+		Labels:  map[string]string{"team": "storage"},
+		Message: "{{.mount}} is {{.missing}}full",
+		Rule:    Rule{Condition: `disk.used_pct{mount=~"/var.*"} > 90`},
+	}}}
+	if err := compileConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]float64{
+		seriesKey("disk.used_pct", Labels{"mount": "/"}):        99,
+		seriesKey("disk.used_pct", Labels{"mount": "/var"}):     95,
+		seriesKey("disk.used_pct", Labels{"mount": "/var/lib"}): 96,
+		seriesKey("disk.used_pct", Labels{"mount": "/var/tmp"}): 10,
+	}
+
+	events := NewEvaluator().Step(cfg, metrics, time.Unix(1700000000, 0))
+	if len(events) != 2 {
+		t.Fatalf("%d events, want one per full /var mount: %v", len(events), events)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Alert < events[j].Alert })
+	for i, mount := range []string{"/var", "/var/lib"} {
+		e := events[i]
+		if e.Alert != "disk_full_"+mount {
+			t.Errorf("name = %q, want disk_full_%s", e.Alert, mount)
+		}
+		if e.Message != mount+" is full" {
+			t.Errorf("message = %q", e.Message)
+		}
+		if e.Labels["mount"] != mount || e.Labels["team"] != "storage" || e.Labels["alertname"] != "disk_full_{{.mount}}" {
+			t.Errorf("labels = %v", e.Labels)
+		}
+		key := seriesKey("disk.used_pct", Labels{"mount": mount})
+		if len(e.Values) != 1 || e.Values[key] != metrics[key] {
+			t.Errorf("values = %v, want only %s", e.Values, key)
+		}
+	}
+}
+
+func TestLocalSeriesBesideAgents(t *testing.T) {
+	cfg := Config{Alerts: []Alert{
+		{Name: "cpu_high", Rule: Rule{Condition: "cpu > 2"}},
+		{Name: "cpu_disk", Missing: MissingFiring, Rule: Rule{Condition: `cpu > 2 and disk.used_pct{mount="/"} > 90`}},
+	}}
+	if err := compileConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]float64{
+		"cpu":                                    3,
+		seriesKey("cpu", Labels{"host": "web1"}): 1,
+		seriesKey("disk.used_pct", Labels{"mount": "/"}):                 95,
+		seriesKey("cpu", Labels{"host": "web2"}):                         5,
+		seriesKey("disk.used_pct", Labels{"host": "web2", "mount": "/"}): 10,
+	}
+
+	ev := NewEvaluator()
+	ev.Step(cfg, metrics, time.Unix(1700000000, 0))
+	for _, tt := range []struct {
+		alert    string
+		instance Labels
+		want     AlertState
+	}{
+		{"cpu_high", nil, StateFiring},
+		{"cpu_high", Labels{"host": "web1"}, StateInactive},
+		{"cpu_high", Labels{"host": "web2"}, StateFiring},
+		{"cpu_disk", Labels{"mount": "/"}, StateFiring},
+		{"cpu_disk", Labels{"host": "web2", "mount": "/"}, StateInactive},
+		// The local instance covers the unlabeled cpu: no extra empty
+		// instance that would fire on its missing disk.
+		{"cpu_disk", nil, StateInactive},
+	} {
+		if got := ev.State(tt.alert, tt.instance); got != tt.want {
+			t.Errorf("%s %v is %s, want %s", tt.alert, tt.instance, got, tt.want)
+		}
+	}
+}
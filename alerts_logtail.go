@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ---------------- LOG TAIL ----------------
+
+// LogPattern counts the lines of a tailed log that match Regex:
+//
+//	sources:
+//	  - name: nginx_log
+//	    type: log
+//	    path: /var/log/nginx/access.log
+//	    windows: [1m, 5m]            # default [1m]
+//	    patterns:
+//	      - name: nginx_5xx
+//	        regex: '" 5\d\d '
+//
+// Every pattern is published as
+//
+//	log.<name>.count_<window>   matching lines within the window
+//	log.<name>.rate_<window>    the same per second
+//	log.<name>.total            matching lines since the source started
+//
+// and as labeled series log.rate_1m{pattern="<name>"} and so on. Lines are
+// timed when they are read, so windows are only as fine as the source's
+// interval. Tailing starts at the end of the file and follows both rename
+// and copy-truncate rotation; the rest of a renamed file is read before
+// switching to the new one.
+type LogPattern struct {
+	Name  string `mapstructure:"name"`
+	Regex string `mapstructure:"regex"`
+}
+
+const (
+	maxLogLine      = 64 * 1024
+	maxLogReadBytes = 64 << 20 // per collection, so a huge backlog cannot stall a tick
+)
+
+var defaultLogWindows = []time.Duration{time.Minute}
+
+type logPattern struct {
+	name  string
+	re    *regexp.Regexp
+	total float64
+}
+
+// logBucket is the number of matches per pattern read in one collection.
+type logBucket struct {
+	at     time.Time
+	counts []float64
+}
+
+type logSource struct {
+	path     string
+	windows  []time.Duration
+	patterns []*logPattern
+
+	mu      sync.Mutex
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte // a line still being written
+	buckets []logBucket
+	started bool
+	closed  bool
+}
+
+func newLogSource(sc SourceConfig) (MetricSource, error) {
+	if sc.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	if len(sc.Patterns) == 0 {
+		return nil, fmt.Errorf("patterns is required")
+	}
+
+	src := &logSource{path: sc.Path, windows: sc.Windows}
+	if len(src.windows) == 0 {
+		src.windows = defaultLogWindows
+	}
+	for i, w := range src.windows {
+		if w <= 0 || w%time.Second != 0 {
+			return nil, fmt.Errorf("windows[%d]: must be a positive whole number of seconds", i)
+		}
+	}
+
+	seen := make(map[string]bool, len(sc.Patterns))
+	for i, lp := range sc.Patterns {
+		if !validMetricSegment(lp.Name) {
+			return nil, fmt.Errorf("patterns[%d]: name %q must be a letter followed by letters, digits or _", i, lp.Name)
+		}
+		if seen[lp.Name] {
+			return nil, fmt.Errorf("patterns[%d]: duplicate name %q", i, lp.Name)
+		}
+		seen[lp.Name] = true
+		re, err := regexp.Compile(lp.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("patterns[%d]: bad regex: %v", i, err)
+		}
+		src.patterns = append(src.patterns, &logPattern{name: lp.Name, re: re})
+	}
+	return src, nil
+}
+
+func (l *logSource) Collect(ctx context.Context) (map[string]float64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, fmt.Errorf("%s: source stopped", l.path)
+	}
+
+	now := time.Now()
+	counts := make([]float64, len(l.patterns))
+	err := l.follow(ctx, counts)
+
+	// A failed follow may have read part of the file already; the offset
+	// has moved past those lines, so they are counted even so.
+	for i, p := range l.patterns {
+		p.total += counts[i]
+	}
+	longest := l.windows[0]
+	for _, w := range l.windows[1:] {
+		if w > longest {
+			longest = w
+		}
+	}
+	l.buckets = append(l.buckets, logBucket{at: now, counts: counts})
+	for len(l.buckets) > 0 && !l.buckets[0].at.After(now.Add(-longest)) {
+		l.buckets = l.buckets[1:]
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]float64, len(l.patterns)*(2*len(l.windows)+1)*2)
+	for i, p := range l.patterns {
+		values := map[string]float64{"total": p.total}
+		for _, w := range l.windows {
+			var n float64
+			for _, b := range l.buckets {
+				if b.at.After(now.Add(-w)) {
+					n += b.counts[i]
+				}
+			}
+			suffix := shortDuration(w)
+			values["count_"+suffix] = n
+			values["rate_"+suffix] = n / w.Seconds()
+		}
+		labels := Labels{"pattern": p.name}
+		for field, v := range values {
+			metrics["log."+p.name+"."+field] = v
+			metrics[seriesKey("log."+field, labels)] = v
+		}
+	}
+	return metrics, nil
+}
+
+// follow reads what was appended since the last collection, switching to
+// a new file after rotation, and adds the matches to counts.
+func (l *logSource) follow(ctx context.Context, counts []float64) error {
+	info, err := os.Stat(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if l.file != nil && (info == nil || !os.SameFile(info, l.info)) {
+		// Renamed away: finish the old file, then start on the new one.
+		if err := l.read(ctx, counts); err != nil {
+			return err
+		}
+		l.file.Close()
+		l.file, l.info, l.offset, l.partial = nil, nil, 0, nil
+	}
+	if info == nil {
+		// A file that shows up later is all new.
+		l.started = true
+		return nil
+	}
+
+	if l.file == nil {
+		f, err := os.Open(l.path)
+		if err != nil {
+			return err
+		}
+		l.file, l.info = f, info
+		l.offset = 0
+		if !l.started {
+			// Only lines written from now on count. Until the file has
+			// been opened once, a failed attempt must not lose this.
+			l.offset = info.Size()
+			l.started = true
+		}
+	} else if info.Size() < l.offset {
+		// Copy-truncate rotation.
+		l.offset, l.partial = 0, nil
+	}
+	l.info = info
+	return l.read(ctx, counts)
+}
+
+func (l *logSource) read(ctx context.Context, counts []float64) error {
+	buf := make([]byte, 32*1024)
+	var read int64
+	for read < maxLogReadBytes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := l.file.ReadAt(buf, l.offset)
+		l.offset += int64(n)
+		read += int64(n)
+		l.scan(buf[:n], counts)
+		if err == io.EOF || n == 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan matches every complete line in data, keeping an unfinished last
+// line for the next read. Lines longer than maxLogLine are matched on
+// their first maxLogLine bytes.
+func (l *logSource) scan(data []byte, counts []float64) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			if room := maxLogLine - len(l.partial); room > 0 {
+				if len(data) > room {
+					data = data[:room]
+				}
+				l.partial = append(l.partial, data...)
+			}
+			return
+		}
+		line := data[:i]
+		if len(l.partial) > 0 {
+			line = append(l.partial, line...)
+			l.partial = nil
+		}
+		if len(line) > maxLogLine {
+			line = line[:maxLogLine]
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		for j, p := range l.patterns {
+			if p.re.Match(line) {
+				counts[j]++
+			}
+		}
+		data = data[i+1:]
+	}
+}
+
+// Close releases the tailed file.
+func (l *logSource) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// shortDuration renders a window for a metric name: 30s, 1m, 1h30m -> 90m.
+func shortDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func appendLog(t *testing.T, path, text string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogSourceRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendLog(t, path, "GET / 500\nGET / 503\n") // written before tailing starts
+
+	src, err := newLogSource(SourceConfig{Path: path, Windows: []time.Duration{time.Minute, time.Hour}, Patterns: []LogPattern{
+		{Name: "errors", Regex: ` 5\d\d$`},
+		{Name: "lines", Regex: `.`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := src.(*logSource)
+	defer l.Close()
+
+	collect := func(step string, errors, lines float64) map[string]float64 {
+		t.Helper()
+		metrics, err := l.Collect(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if got := metrics["log.errors.total"]; got != errors {
+			t.Errorf("%s: log.errors.total = %v, want %v", step, got, errors)
+		}
+		if got := metrics[seriesKey("log.total", Labels{"pattern": "lines"})]; got != lines {
+			t.Errorf("%s: lines total = %v, want %v", step, got, lines)
+		}
+		return metrics
+	}
+
+	collect("start", 0, 0)
+
+	appendLog(t, path, "GET / 200\nGET / 502\nGET /x 50")
+	collect("append", 1, 2)
+	appendLog(t, path, "4\n")
+	metrics := collect("finished line", 2, 3)
+	if got := metrics["log.errors.count_1m"]; got != 2 {
+		t.Errorf("log.errors.count_1m = %v, want 2", got)
+	}
+	if got := metrics["log.errors.rate_1h"]; got != 2.0/3600 {
+		t.Errorf("log.errors.rate_1h = %v, want 2/3600", got)
+	}
+
+	// Rename rotation: the rest of the old file is read, then the new one
+	// from its start.
+	appendLog(t, path, "GET / 500\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path, "GET / 200\nGET / 501\n")
+	collect("rename", 4, 6)
+
+	appendLog(t, path+".1", "GET / 500\n") // no longer followed
+	appendLog(t, path, "GET / 200\n")
+	collect("after rename", 4, 7)
+
+	// Copy-truncate rotation.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path, "GET / 599\n")
+	collect("truncate", 5, 8)
+
+	// The file vanishing is not an error; it is picked up again once back.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	collect("removed", 5, 8)
+	appendLog(t, path, "GET / 500\n")
+	collect("recreated", 6, 9)
+}
+
+func TestLogSourceFailedStart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	path := filepath.Join(dir, "access.log")
+	appendLog(t, dir, "") // a file where the directory should be
+
+	src, err := newLogSource(SourceConfig{Path: path, Patterns: []LogPattern{{Name: "errors", Regex: ` 5\d\d$`}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := src.(*logSource)
+	defer l.Close()
+	if _, err := l.Collect(context.Background()); err == nil {
+		t.Fatal("first collection succeeded on an unreadable path")
+	}
+
+	// Once readable, the backlog is still skipped: tailing only starts now.
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, path, "GET / 500\nGET / 503\n")
+	metrics, err := l.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics["log.errors.total"]; got != 0 {
+		t.Errorf("log.errors.total = %v, want the old lines skipped", got)
+	}
+	appendLog(t, path, "GET / 502\n")
+	if metrics, _ = l.Collect(context.Background()); metrics["log.errors.total"] != 1 {
+		t.Errorf("log.errors.total = %v, want 1", metrics["log.errors.total"])
+	}
+}
+
+func TestShortDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		30 * time.Second: "30s",
+		time.Minute:      "1m",
+		90 * time.Minute: "90m",
+		2 * time.Hour:    "2h",
+		90 * time.Second: "90s",
+	} {
+		if got := shortDuration(d); got != want {
+			t.Errorf("shortDuration(%s) = %s, want %s", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- NOTIFIERS ----------------
+
+// Notifier delivers a group of alert events to an external system.
+type Notifier interface {
+	Notify(ctx context.Context, group AlertGroup) error
+}
+
+// AlertGroup is one notification. Routes without group_by send every event
+// on its own, with nil Labels; grouped routes batch the events that share
+// the group_by labels.
+type AlertGroup struct {
+	Labels Labels
+	Events []AlertEvent
+}
+
+func (g AlertGroup) grouped() bool {
+	return g.Labels != nil
+}
+
+// String names the group in logs.
+func (g AlertGroup) String() string {
+	if !g.grouped() {
+		return g.Events[0].Alert
+	}
+	return fmt.Sprintf("%d alerts %s", len(g.Events), g.Labels.Key())
+}
+
+// ReceiverConfig is one entry of the `receivers` section. Exactly one of the
+// channel blocks must be set:
+//
+//	receivers:
+//	  - name: oncall
+//	    slack:
+//	      url: https://hooks.slack.com/services/...
+//	  - name: ops-mail
+//	    email:
+//	      host: smtp.example.com
+//	      port: 587
+//	      from: alerts@example.com
+//	      to: [ops@example.com]
+type ReceiverConfig struct {
+	Name    string         `mapstructure:"name"`
+	Webhook *WebhookConfig `mapstructure:"webhook"`
+	Slack   *SlackConfig   `mapstructure:"slack"`
+	Email   *EmailConfig   `mapstructure:"email"`
+	Exec    *ExecConfig    `mapstructure:"exec"`
+	Retry   RetryConfig    `mapstructure:"retry"`
+}
+
+type WebhookConfig struct {
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	Timeout time.Duration     `mapstructure:"timeout"`
+}
+
+type SlackConfig struct {
+	URL      string        `mapstructure:"url"`
+	Channel  string        `mapstructure:"channel"`
+	Username string        `mapstructure:"username"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+type EmailConfig struct {
+	Host     string   `mapstructure:"host"`
+	Port     int      `mapstructure:"port"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+}
+
+type ExecConfig struct {
+	Command string        `mapstructure:"command"`
+	Args    []string      `mapstructure:"args"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// RetryConfig controls exponential backoff between delivery attempts.
+type RetryConfig struct {
+	Attempts   int           `mapstructure:"attempts"`
+	Backoff    time.Duration `mapstructure:"backoff"`
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+}
+
+const defaultNotifyTimeout = 10 * time.Second
+
+func (r RetryConfig) withDefaults() RetryConfig {
+	if r.Attempts <= 0 {
+		r.Attempts = 3
+	}
+	if r.Backoff <= 0 {
+		r.Backoff = time.Second
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = time.Minute
+	}
+	return r
+}
+
+func newNotifier(rc ReceiverConfig) (Notifier, error) {
+	var n []Notifier
+	if rc.Webhook != nil {
+		if rc.Webhook.URL == "" {
+			return nil, fmt.Errorf("webhook.url is required")
+		}
+		n = append(n, &webhookNotifier{cfg: *rc.Webhook})
+	}
+	if rc.Slack != nil {
+		if rc.Slack.URL == "" {
+			return nil, fmt.Errorf("slack.url is required")
+		}
+		n = append(n, &slackNotifier{cfg: *rc.Slack})
+	}
+	if rc.Email != nil {
+		if rc.Email.Host == "" || rc.Email.From == "" || len(rc.Email.To) == 0 {
+			return nil, fmt.Errorf("email needs host, from and to")
+		}
+		n = append(n, &emailNotifier{cfg: *rc.Email})
+	}
+	if rc.Exec != nil {
+		if rc.Exec.Command == "" {
+			return nil, fmt.Errorf("exec.command is required")
+		}
+		n = append(n, &execNotifier{cfg: *rc.Exec})
+	}
+
+	if len(n) != 1 {
+		return nil, fmt.Errorf("exactly one of webhook, slack, email or exec is required")
+	}
+	return n[0], nil
+}
+
+func postJSON(ctx context.Context, url string, headers map[string]string, timeout time.Duration, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		timeout = defaultNotifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// ---------------- WEBHOOK ----------------
+
+type webhookNotifier struct {
+	cfg WebhookConfig
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, g AlertGroup) error {
+	return postJSON(ctx, w.cfg.URL, w.cfg.Headers, w.cfg.Timeout, notifyPayload(g))
+}
+
+// ---------------- SLACK ----------------
+
+type slackNotifier struct {
+	cfg SlackConfig
+}
+
+func (s *slackNotifier) Notify(ctx context.Context, g AlertGroup) error {
+	text := groupSummary(g)
+	if g.grouped() {
+		for _, e := range g.Events {
+			text += "\n• " + notificationText(e)
+		}
+	}
+	msg := map[string]string{"text": text}
+	if s.cfg.Channel != "" {
+		msg["channel"] = s.cfg.Channel
+	}
+	if s.cfg.Username != "" {
+		msg["username"] = s.cfg.Username
+	}
+	return postJSON(ctx, s.cfg.URL, nil, s.cfg.Timeout, msg)
+}
+
+func notificationText(e AlertEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", strings.ToUpper(string(e.State)), e.Alert)
+	if len(e.Labels) > 0 {
+		fmt.Fprintf(&b, " %v", e.Labels)
+	}
+	switch e.State {
+	case StateFiring:
+		fmt.Fprintf(&b, " since %s", e.FiredAt.Format(time.RFC3339))
+	case StateResolved:
+		fmt.Fprintf(&b, " after %s", e.ResolvedAt.Sub(e.FiredAt).Round(time.Second))
+	}
+	return b.String()
+}
+
+// groupSummary is a one-line description of g, e.g.
+// "[FIRING:3, RESOLVED:1] {host="db1"}".
+func groupSummary(g AlertGroup) string {
+	if !g.grouped() {
+		return notificationText(g.Events[0])
+	}
+
+	counts := make(map[AlertState]int)
+	var order []AlertState
+	for _, e := range g.Events {
+		if counts[e.State] == 0 {
+			order = append(order, e.State)
+		}
+		counts[e.State]++
+	}
+	parts := make([]string, len(order))
+	for i, state := range order {
+		parts[i] = fmt.Sprintf("%s:%d", strings.ToUpper(string(state)), counts[state])
+	}
+	return fmt.Sprintf("[%s] %s", strings.Join(parts, ", "), g.Labels.Key())
+}
+
+// ---------------- EMAIL ----------------
+
+type emailNotifier struct {
+	cfg EmailConfig
+}
+
+func (m *emailNotifier) Notify(ctx context.Context, g AlertGroup) error {
+	port := m.cfg.Port
+	if port == 0 {
+		port = 25
+	}
+	addr := m.cfg.Host + ":" + strconv.Itoa(port)
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+
+	body, _ := json.MarshalIndent(notifyPayload(g), "", "  ")
+	msg := emailMessage(m.cfg.From, m.cfg.To, groupSummary(g), body)
+
+	// net/smtp has no context support; run it aside so cancellation is honoured.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(addr, auth, m.cfg.From, m.cfg.To, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// emailMessage assembles the mail. The subject is built from alert labels,
+// which agents and templates control, so it is Q-encoded: a CR or LF in it
+// cannot start a header of its own. The addresses get the same protection
+// by dropping line breaks.
+func emailMessage(from string, to []string, subject string, body []byte) string {
+	noBreaks := strings.NewReplacer("\r", "", "\n", "")
+	return "From: " + noBreaks.Replace(from) + "\r\n" +
+		"To: " + noBreaks.Replace(strings.Join(to, ", ")) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + string(body) + "\r\n"
+}
+
+// ---------------- EXEC ----------------
+
+// execNotifier runs a command with the JSON payload on stdin and the basics
+// in ALERT_NAME, ALERT_STATE and ALERT_PREVIOUS. For a grouped notification
+// these describe the first event and ALERT_COUNT holds the group size.
+type execNotifier struct {
+	cfg ExecConfig
+}
+
+func (x *execNotifier) Notify(ctx context.Context, g AlertGroup) error {
+	timeout := x.cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultNotifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	data, err := json.Marshal(notifyPayload(g))
+	if err != nil {
+		return err
+	}
+	e := g.Events[0]
+
+	cmd := exec.CommandContext(ctx, x.cfg.Command, x.cfg.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"ALERT_NAME="+e.Alert,
+		"ALERT_STATE="+string(e.State),
+		"ALERT_PREVIOUS="+string(e.Previous),
+		"ALERT_COUNT="+strconv.Itoa(len(g.Events)),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", x.cfg.Command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// ---------------- ROUTING ----------------
+
+// RoutingConfig picks receivers for an event. Routes are tried in order; the
+// first match wins unless it sets `continue`. Events matching no route go
+// to the default receivers.
+//
+// With group_by, events sharing those labels are held for group_wait
+// (default 30s) and sent as one notification. Routes inherit the top-level
+// grouping unless they set their own.
+//
+//	routing:
+//	  default: [ops-mail]
+//	  group_by: [host]
+//	  routes:
+//	    - alert: disk_full
+//	      receivers: [oncall]
+//	    - labels: {team: db}
+//	      receivers: [db-webhook]
+//	      group_by: [alertname]
+//	      group_wait: 1m
+type RoutingConfig struct {
+	Default   []string      `mapstructure:"default"`
+	GroupBy   []string      `mapstructure:"group_by"`
+	GroupWait time.Duration `mapstructure:"group_wait"`
+	Routes    []Route       `mapstructure:"routes"`
+}
+
+type Route struct {
+	Alert     string            `mapstructure:"alert"`
+	Labels    map[string]string `mapstructure:"labels"`
+	Receivers []string          `mapstructure:"receivers"`
+	Continue  bool              `mapstructure:"continue"`
+	GroupBy   []string          `mapstructure:"group_by"`
+	GroupWait time.Duration     `mapstructure:"group_wait"`
+}
+
+const defaultGroupWait = 30 * time.Second
+
+func (r Route) matches(e AlertEvent) bool {
+	if r.Alert != "" && !alertNameMatches(r.Alert, e) {
+		return false
+	}
+	for k, v := range r.Labels {
+		if e.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func validateNotifications(cfg *Config, errs *ConfigError) {
+	names := make(map[string]bool, len(cfg.Receivers))
+	for i, rc := range cfg.Receivers {
+		path := fmt.Sprintf("receivers[%d]", i)
+		switch {
+		case rc.Name == "":
+			errs.add(path, "name is required")
+		case names[rc.Name]:
+			errs.add(path, "duplicate receiver name %q", rc.Name)
+		}
+		names[rc.Name] = true
+		if _, err := newNotifier(rc); err != nil {
+			errs.add(path, "%v", err)
+		}
+	}
+
+	checkRefs := func(path string, refs []string) {
+		for i, name := range refs {
+			if !names[name] {
+				errs.add(fmt.Sprintf("%s[%d]", path, i), "unknown receiver %q", name)
+			}
+		}
+	}
+	checkRefs("routing.default", cfg.Routing.Default)
+	if cfg.Routing.GroupWait < 0 {
+		errs.add("routing.group_wait", "must not be negative")
+	}
+	for i, r := range cfg.Routing.Routes {
+		path := fmt.Sprintf("routing.routes[%d]", i)
+		if len(r.Receivers) == 0 {
+			errs.add(path, "receivers is required")
+		}
+		checkRefs(path+".receivers", r.Receivers)
+		if r.GroupWait < 0 {
+			errs.add(path+".group_wait", "must not be negative")
+		}
+	}
+}
+
+// ---------------- DISPATCHER ----------------
+
+type receiver struct {
+	name     string
+	notifier Notifier
+	retry    RetryConfig
+}
+
+// target is one receiver an event is routed to, with the grouping of the
+// route that picked it.
+type target struct {
+	receiver  string
+	groupBy   []string
+	groupWait time.Duration
+}
+
+// pendingGroup collects events for one receiver and group until it is sent.
+type pendingGroup struct {
+	labels Labels
+	events []AlertEvent
+	index  map[string]int // alert instance -> position in events
+}
+
+// Dispatcher routes events to receivers and delivers them in the
+// background, retrying failed deliveries with exponential backoff.
+type Dispatcher struct {
+	receivers map[string]*receiver
+	routing   RoutingConfig
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu     sync.Mutex
+	groups map[string]*pendingGroup
+}
+
+// NewDispatcher builds notifiers for cfg. cfg must already be validated.
+func NewDispatcher(cfg Config) (*Dispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		receivers: make(map[string]*receiver, len(cfg.Receivers)),
+		routing:   cfg.Routing,
+		ctx:       ctx,
+		cancel:    cancel,
+		groups:    make(map[string]*pendingGroup),
+	}
+	for _, rc := range cfg.Receivers {
+		n, err := newNotifier(rc)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("receiver %q: %v", rc.Name, err)
+		}
+		d.receivers[rc.Name] = &receiver{name: rc.Name, notifier: n, retry: rc.Retry.withDefaults()}
+	}
+	return d, nil
+}
+
+// Stop abandons deliveries still waiting on a retry.
+func (d *Dispatcher) Stop() {
+	d.cancel()
+}
+
+// Receivers returns the receiver names an event is routed to.
+func (d *Dispatcher) Receivers(e AlertEvent) []string {
+	targets := d.targets(e)
+	out := make([]string, len(targets))
+	for i, t := range targets {
+		out[i] = t.receiver
+	}
+	return out
+}
+
+func (d *Dispatcher) targets(e AlertEvent) []target {
+	var out []target
+	seen := make(map[string]bool)
+	add := func(names []string, groupBy []string, groupWait time.Duration) {
+		if groupBy == nil {
+			groupBy, groupWait = d.routing.GroupBy, d.routing.GroupWait
+		}
+		if groupWait <= 0 {
+			groupWait = defaultGroupWait
+		}
+		for _, n := range names {
+			if !seen[n] {
+				seen[n] = true
+				out = append(out, target{receiver: n, groupBy: groupBy, groupWait: groupWait})
+			}
+		}
+	}
+
+	for _, r := range d.routing.Routes {
+		if !r.matches(e) {
+			continue
+		}
+		add(r.Receivers, r.GroupBy, r.GroupWait)
+		if !r.Continue {
+			return out
+		}
+	}
+	if len(out) == 0 {
+		add(d.routing.Default, nil, 0)
+	}
+	return out
+}
+
+// Dispatch queues e for every matching receiver and returns immediately.
+// Events on grouped routes wait for the rest of their group. Only alerts
+// that start firing, and the resolution of those that fired, are sent;
+// pending and its fall back to inactive stay on the dashboard and in
+// history, so a for: duration keeps a brief breach from paging anyone.
+// Flapping tag changes on an alert that keeps firing are not sent again.
+func (d *Dispatcher) Dispatch(e AlertEvent) {
+	if !notifiable(e) {
+		return
+	}
+	for _, t := range d.targets(e) {
+		r, ok := d.receivers[t.receiver]
+		if !ok {
+			continue
+		}
+		if len(t.groupBy) == 0 {
+			go d.deliver(r, AlertGroup{Events: []AlertEvent{e}})
+			continue
+		}
+		d.enqueue(r, t, e)
+	}
+}
+
+func notifiable(e AlertEvent) bool {
+	switch e.State {
+	case StateFiring:
+		return e.Previous != StateFiring
+	case StateResolved:
+		return e.Previous == StateFiring
+	}
+	return false
+}
+
+// enqueue adds e to its pending group, starting the group's timer if it is
+// the first event. A later event for the same alert instance replaces the
+// earlier one, so a group carries each instance's latest state.
+func (d *Dispatcher) enqueue(r *receiver, t target, e AlertEvent) {
+	labels := make(Labels, len(t.groupBy))
+	for _, name := range t.groupBy {
+		labels[name] = e.Labels[name]
+	}
+	key := r.name + labels.Key()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.groups[key]
+	if !ok {
+		g = &pendingGroup{labels: labels, index: make(map[string]int)}
+		d.groups[key] = g
+		time.AfterFunc(t.groupWait, func() { d.flush(r, key) })
+	}
+	if i, ok := g.index[e.Instance]; ok {
+		g.events[i] = e
+		return
+	}
+	g.index[e.Instance] = len(g.events)
+	g.events = append(g.events, e)
+}
+
+func (d *Dispatcher) flush(r *receiver, key string) {
+	d.mu.Lock()
+	g := d.groups[key]
+	delete(d.groups, key)
+	d.mu.Unlock()
+
+	if g != nil {
+		d.deliver(r, AlertGroup{Labels: g.labels, Events: g.events})
+	}
+}
+
+func (d *Dispatcher) deliver(r *receiver, g AlertGroup) {
+	backoff := r.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := r.notifier.Notify(d.ctx, g)
+		if err == nil {
+			return
+		}
+		if attempt >= r.retry.Attempts {
+			log.Printf("notify %s: giving up on %s after %d attempts: %v", r.name, g, attempt, err)
+			return
+		}
+		log.Printf("notify %s: attempt %d for %s failed, retrying in %s: %v", r.name, attempt, g, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > r.retry.MaxBackoff {
+			backoff = r.retry.MaxBackoff
+		}
+	}
+}
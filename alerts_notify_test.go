@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingNotifier hands every group it is asked to deliver to a channel.
+type recordingNotifier chan AlertGroup
+
+func (n recordingNotifier) Notify(ctx context.Context, g AlertGroup) error {
+	n <- g
+	return nil
+}
+
+// testDispatcher routes every event to one receiver that records it.
+func testDispatcher(t *testing.T, routing RoutingConfig) (*Dispatcher, recordingNotifier) {
+	t.Helper()
+	routing.Default = []string{"rec"}
+	d, err := NewDispatcher(Config{
+		Receivers: []ReceiverConfig{{Name: "rec", Webhook: &WebhookConfig{URL: "http://127.0.0.1:9/"}}},
+		Routing:   routing,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Stop)
+	n := make(recordingNotifier, 16)
+	d.receivers["rec"].notifier = n
+	return d, n
+}
+
+func awaitGroup(t *testing.T, n recordingNotifier) AlertGroup {
+	t.Helper()
+	select {
+	case g := <-n:
+		return g
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+		return AlertGroup{}
+	}
+}
+
+func hostEvent(name, host string, state AlertState) AlertEvent {
+	prev := StatePending
+	if state == StateResolved {
+		prev = StateFiring
+	}
+	return AlertEvent{
+		Alert:    name,
+		Instance: instanceKey(name, Labels{"host": host}),
+		Labels:   map[string]string{"alertname": name, "host": host},
+		State:    state,
+		Previous: prev,
+		Time:     time.Now(),
+	}
+}
+
+func TestDispatcherGroupsByLabels(t *testing.T) {
+	d, n := testDispatcher(t, RoutingConfig{GroupBy: []string{"host"}, GroupWait: 100 * time.Millisecond})
+
+	d.Dispatch(hostEvent("cpu_high", "a", StateFiring))
+	d.Dispatch(hostEvent("disk_full", "a", StateFiring))
+	d.Dispatch(hostEvent("cpu_high", "b", StateFiring))
+	d.Dispatch(hostEvent("cpu_high", "a", StateResolved)) // replaces the firing event
+
+	groups := []AlertGroup{awaitGroup(t, n), awaitGroup(t, n)}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Labels["host"] < groups[j].Labels["host"] })
+
+	a, b := groups[0], groups[1]
+	if a.Labels.Key() != `{host="a"}` || len(a.Events) != 2 {
+		t.Fatalf("group a = %v with %d events, want host a with 2", a.Labels, len(a.Events))
+	}
+	if a.Events[0].Alert != "cpu_high" || a.Events[0].State != StateResolved || a.Events[1].Alert != "disk_full" {
+		t.Errorf("group a events = %v, want cpu_high resolved then disk_full", a.Events)
+	}
+	if b.Labels.Key() != `{host="b"}` || len(b.Events) != 1 {
+		t.Errorf("group b = %v with %d events", b.Labels, len(b.Events))
+	}
+
+	select {
+	case g := <-n:
+		t.Errorf("unexpected extra notification %s", g)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDispatcherUngroupedRoutes(t *testing.T) {
+	d, n := testDispatcher(t, RoutingConfig{
+		GroupBy:   []string{"host"},
+		GroupWait: time.Hour,
+		Routes: []Route{
+			{Alert: "cpu_high", Receivers: []string{"rec"}, GroupBy: []string{}},
+		},
+	})
+
+	d.Dispatch(hostEvent("cpu_high", "a", StateFiring))
+	g := awaitGroup(t, n)
+	if g.grouped() || len(g.Events) != 1 || g.Events[0].Alert != "cpu_high" {
+		t.Errorf("got %v grouped %v, want cpu_high on its own", g, g.grouped())
+	}
+}
+
+func TestNotifiable(t *testing.T) {
+	tests := []struct {
+		state, previous AlertState
+		want            bool
+	}{
+		{StateFiring, StatePending, true},
+		{StateFiring, StateInactive, true},
+		{StateFiring, StateFiring, false}, // flapping tag changed
+		{StateResolved, StateFiring, true},
+		{StateResolved, StateResolved, false},
+		{StatePending, StateInactive, false},
+		{StateInactive, StatePending, false},
+	}
+	for _, tt := range tests {
+		if got := notifiable(AlertEvent{State: tt.state, Previous: tt.previous}); got != tt.want {
+			t.Errorf("notifiable(%s after %s) = %v, want %v", tt.state, tt.previous, got, tt.want)
+		}
+	}
+}
+
+func TestEmailHeaderInjection(t *testing.T) {
+	subject := "FIRING cpu_high {host=\"web1\r\nBcc: victim@example.com\"}"
+	msg := emailMessage("alerts@example.com\r\nBcc: a@example.com", []string{"ops@example.com"}, subject, []byte("{}"))
+
+	header, _, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header/body separator in %q", msg)
+	}
+	lines := strings.Split(header, "\r\n")
+	if len(lines) != 4 {
+		t.Errorf("%d header lines, want 4: %q", len(lines), lines)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Bcc:") || strings.ContainsAny(line, "\r\n") {
+			t.Errorf("injected header line %q", line)
+		}
+	}
+	encoded := strings.TrimPrefix(lines[2], "Subject: ")
+	if got, err := new(mime.WordDecoder).DecodeHeader(encoded); err != nil || got != subject {
+		t.Errorf("subject decodes to %q (%v), want %q", got, err, subject)
+	}
+	if plain := emailMessage("a@example.com", nil, "FIRING cpu_high", nil); !strings.Contains(plain, "\r\nSubject: FIRING cpu_high\r\n") {
+		t.Errorf("plain subject encoded: %q", plain)
+	}
+}
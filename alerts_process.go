@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// ---------------- PROCESSES ----------------
+
+// ProcessMatch selects the processes one group of metrics covers, either
+// by process name or by a regexp matched anywhere in the command line:
+//
+//	sources:
+//	  - name: procs
+//	    type: process
+//	    processes:
+//	      - name: nginx
+//	        process: nginx              # as in /proc/<pid>/comm, at most 15 characters
+//	      - name: worker
+//	        cmdline: 'python3? .*worker\.py'
+//
+// Every group is published as
+//
+//	process.<name>.count                 matching processes, 0 when none run
+//	process.<name>.cpu                   percent of one core, summed
+//	process.<name>.rss                   bytes, summed
+//	process.<name>.open_files, .threads  summed
+//
+// and as labeled series process.count{process="<name>"} and so on, so
+// process.nginx.count < 1 catches a crashed daemon and
+// process.rss{process=~".*"} > 2GiB covers every group.
+type ProcessMatch struct {
+	Name    string `mapstructure:"name"`
+	Process string `mapstructure:"process"`
+	Cmdline string `mapstructure:"cmdline"`
+}
+
+type processMatcher struct {
+	name    string
+	process string
+	cmdline *regexp.Regexp
+}
+
+func (m processMatcher) matches(name string, cmdline func() string) bool {
+	if m.cmdline != nil {
+		return m.cmdline.MatchString(cmdline())
+	}
+	return name == m.process
+}
+
+// procCPU is the CPU time a process had used when last collected.
+type procCPU struct {
+	created int64
+	seconds float64
+	at      time.Time
+}
+
+type processTotals struct {
+	count, cpu, rss, openFiles, threads float64
+}
+
+type processSource struct {
+	matchers []processMatcher
+
+	mu   sync.Mutex
+	prev map[int32]procCPU
+}
+
+func newProcessSource(sc SourceConfig) (MetricSource, error) {
+	if len(sc.Processes) == 0 {
+		return nil, fmt.Errorf("processes is required")
+	}
+
+	src := &processSource{prev: make(map[int32]procCPU)}
+	seen := make(map[string]bool, len(sc.Processes))
+	for i, pm := range sc.Processes {
+		if !validMetricSegment(pm.Name) {
+			return nil, fmt.Errorf("processes[%d]: name %q must be a letter followed by letters, digits or _", i, pm.Name)
+		}
+		if seen[pm.Name] {
+			return nil, fmt.Errorf("processes[%d]: duplicate name %q", i, pm.Name)
+		}
+		seen[pm.Name] = true
+		if (pm.Process == "") == (pm.Cmdline == "") {
+			return nil, fmt.Errorf("processes[%d]: exactly one of process or cmdline is required", i)
+		}
+
+		m := processMatcher{name: pm.Name, process: pm.Process}
+		if pm.Cmdline != "" {
+			re, err := regexp.Compile(pm.Cmdline)
+			if err != nil {
+				return nil, fmt.Errorf("processes[%d]: bad cmdline regexp: %v", i, err)
+			}
+			m.cmdline = re
+		}
+		src.matchers = append(src.matchers, m)
+	}
+	return src, nil
+}
+
+func validMetricSegment(s string) bool {
+	if s == "" || !isIdentStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isIdentChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect walks the process table once. CPU is the time a process used
+// since the previous collection, so a process contributes 0 the first time
+// it is seen. Processes that exit mid-walk, or whose details are not
+// readable, are still counted.
+func (s *processSource) Collect(ctx context.Context) (map[string]float64, error) {
+	procs, err := process.Processes()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	totals := make([]processTotals, len(s.matchers))
+	current := make(map[int32]procCPU)
+
+	for _, p := range procs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name, err := p.Name()
+		if err != nil {
+			continue
+		}
+		var cmdline *string
+		readCmdline := func() string {
+			if cmdline == nil {
+				c, _ := p.Cmdline()
+				cmdline = &c
+			}
+			return *cmdline
+		}
+
+		var matched []int
+		for i, m := range s.matchers {
+			if m.matches(name, readCmdline) {
+				matched = append(matched, i)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		var t processTotals
+		t.count = 1
+		if times, err := p.Times(); err == nil {
+			created, _ := p.CreateTime()
+			cur := procCPU{created: created, seconds: times.User + times.System, at: now}
+			if prev, ok := s.prev[p.Pid]; ok && prev.created == created {
+				if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+					t.cpu = (cur.seconds - prev.seconds) / elapsed * 100
+				}
+			}
+			current[p.Pid] = cur
+		}
+		if mem, err := p.MemoryInfo(); err == nil {
+			t.rss = float64(mem.RSS)
+		}
+		if fds, err := p.NumFDs(); err == nil {
+			t.openFiles = float64(fds)
+		}
+		if threads, err := p.NumThreads(); err == nil {
+			t.threads = float64(threads)
+		}
+
+		for _, i := range matched {
+			totals[i].count += t.count
+			totals[i].cpu += t.cpu
+			totals[i].rss += t.rss
+			totals[i].openFiles += t.openFiles
+			totals[i].threads += t.threads
+		}
+	}
+	s.prev = current
+
+	metrics := make(map[string]float64, len(s.matchers)*10)
+	for i, m := range s.matchers {
+		values := map[string]float64{
+			"count":      totals[i].count,
+			"cpu":        totals[i].cpu,
+			"rss":        totals[i].rss,
+			"open_files": totals[i].openFiles,
+			"threads":    totals[i].threads,
+		}
+		labels := Labels{"process": m.name}
+		for field, v := range values {
+			metrics["process."+m.name+"."+field] = v
+			metrics[seriesKey("process."+field, labels)] = v
+		}
+	}
+	return metrics, nil
+}
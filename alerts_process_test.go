@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestProcessGroups(t *testing.T) {
+	// GNU sleep sums its arguments; the odd fraction makes the command
+	// line unique to this test.
+	var sleepers []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("sleep", "600", "0.4242")
+		if err := cmd.Start(); err != nil {
+			t.Skipf("cannot start sleep: %v", err)
+		}
+		sleepers = append(sleepers, cmd)
+	}
+	t.Cleanup(func() {
+		for _, cmd := range sleepers {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	})
+
+	src, err := newProcessSource(SourceConfig{Processes: []ProcessMatch{
+		{Name: "sleepers", Cmdline: `^sleep 600 0\.4242$`},
+		{Name: "sleep", Process: "sleep"},
+		{Name: "missing", Process: "no-such-process"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := src.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics["process.sleepers.count"]; got != 2 {
+		t.Errorf("process.sleepers.count = %v, want 2", got)
+	}
+	if got := metrics[seriesKey("process.count", Labels{"process": "sleepers"})]; got != 2 {
+		t.Errorf("labeled count = %v, want 2", got)
+	}
+	if got := metrics["process.sleep.count"]; got < 2 {
+		t.Errorf("process.sleep.count = %v, want at least the 2 sleepers", got)
+	}
+	if metrics["process.sleepers.rss"] <= 0 || metrics["process.sleepers.threads"] < 2 {
+		t.Errorf("sleepers rss %v threads %v, want both summed over 2 processes", metrics["process.sleepers.rss"], metrics["process.sleepers.threads"])
+	}
+	if metrics["process.sleepers.cpu"] != 0 {
+		t.Errorf("cpu on first sight = %v, want 0", metrics["process.sleepers.cpu"])
+	}
+	for _, field := range []string{"count", "cpu", "rss", "open_files", "threads"} {
+		if v, ok := metrics["process.missing."+field]; !ok || v != 0 {
+			t.Errorf("process.missing.%s = %v (present %v), want 0", field, v, ok)
+		}
+	}
+
+	sleepers[0].Process.Kill()
+	sleepers[0].Wait()
+	metrics, err = src.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics["process.sleepers.count"]; got != 1 {
+		t.Errorf("process.sleepers.count after a kill = %v, want 1", got)
+	}
+	if got := metrics["process.sleepers.cpu"]; got < 0 {
+		t.Errorf("process.sleepers.cpu = %v, want >= 0", got)
+	}
+}
+
+func TestProcessSourceValidation(t *testing.T) {
+	for name, pm := range map[string][]ProcessMatch{
+		"none":      nil,
+		"bad name":  {{Name: "ngi-nx", Process: "nginx"}},
+		"duplicate": {{Name: "a", Process: "a"}, {Name: "a", Process: "b"}},
+		"both":      {{Name: "a", Process: "a", Cmdline: "a"}},
+		"neither":   {{Name: "a"}},
+		"regexp":    {{Name: "a", Cmdline: "("}},
+	} {
+		if _, err := newProcessSource(SourceConfig{Processes: pm}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
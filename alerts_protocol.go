@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ---------------- WEBSOCKET PROTOCOL ----------------
+//
+// Every frame in either direction is a JSON envelope:
+//
+//	{"version": 1, "type": "alert", "alert": {...}}
+//
+// Server to client types are "alert", "subscriptions" and "error". Clients
+// send "subscribe" and "unsubscribe" with a filter:
+//
+//	{"version": 1, "type": "subscribe", "alerts": ["disk_full"], "labels": {"team": "db"}}
+//
+// A client that has never subscribed receives every alert. Once it has,
+// it receives only what its subscriptions match, so dropping the last one,
+// or unsubscribing without a filter, which drops them all, stops the
+// stream until it subscribes again.
+
+const protocolVersion = 1
+
+// AlertPayload describes one alert transition. It is shared by the
+// WebSocket protocol and the webhook/exec notifiers.
+type AlertPayload struct {
+	Name       string             `json:"name"`
+	State      AlertState         `json:"state"`
+	Previous   AlertState         `json:"previous"`
+	Severity   string             `json:"severity,omitempty"`
+	Labels     map[string]string  `json:"labels,omitempty"`
+	Message    string             `json:"message,omitempty"`
+	Rule       string             `json:"rule"`
+	Values     map[string]float64 `json:"values,omitempty"`
+	ActiveAt   *time.Time         `json:"active_at,omitempty"`
+	FiredAt    *time.Time         `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time         `json:"resolved_at,omitempty"`
+	Time       time.Time          `json:"time"`
+}
+
+func newAlertPayload(e AlertEvent) AlertPayload {
+	return AlertPayload{
+		Name:       e.Alert,
+		State:      e.State,
+		Previous:   e.Previous,
+		Severity:   e.Severity,
+		Labels:     e.Labels,
+		Message:    e.Message,
+		Rule:       e.Rule,
+		Values:     e.Values,
+		ActiveAt:   timePtr(e.ActiveAt),
+		FiredAt:    timePtr(e.FiredAt),
+		ResolvedAt: timePtr(e.ResolvedAt),
+		Time:       e.Time,
+	}
+}
+
+// AlertGroupPayload is one grouped notification, sent to webhook and exec
+// receivers on routes with group_by instead of a single AlertPayload.
+type AlertGroupPayload struct {
+	Version     int               `json:"version"`
+	GroupLabels map[string]string `json:"group_labels"`
+	Alerts      []AlertPayload    `json:"alerts"`
+}
+
+func newAlertGroupPayload(g AlertGroup) AlertGroupPayload {
+	p := AlertGroupPayload{Version: protocolVersion, GroupLabels: g.Labels}
+	for _, e := range g.Events {
+		p.Alerts = append(p.Alerts, newAlertPayload(e))
+	}
+	return p
+}
+
+// notifyPayload is the JSON body for g: a bare AlertPayload when the route
+// does not group, an AlertGroupPayload when it does.
+func notifyPayload(g AlertGroup) interface{} {
+	if !g.grouped() {
+		return newAlertPayload(g.Events[0])
+	}
+	return newAlertGroupPayload(g)
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Subscription filters alerts by name and/or labels. Empty fields match
+// everything.
+type Subscription struct {
+	Alerts []string          `json:"alerts,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (s Subscription) matches(e AlertEvent) bool {
+	if len(s.Alerts) > 0 {
+		found := false
+		for _, name := range s.Alerts {
+			if alertNameMatches(name, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range s.Labels {
+		if e.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Subscription) equal(o Subscription) bool {
+	if len(s.Alerts) != len(o.Alerts) || len(s.Labels) != len(o.Labels) {
+		return false
+	}
+	for i := range s.Alerts {
+		if s.Alerts[i] != o.Alerts[i] {
+			return false
+		}
+	}
+	for k, v := range s.Labels {
+		if ov, ok := o.Labels[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+type serverMessage struct {
+	Version       int            `json:"version"`
+	Type          string         `json:"type"`
+	Alert         *AlertPayload  `json:"alert,omitempty"`
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+type clientMessage struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Subscription
+}
+
+func encodeAlertMessage(e AlertEvent) ([]byte, error) {
+	p := newAlertPayload(e)
+	return json.Marshal(serverMessage{Version: protocolVersion, Type: "alert", Alert: &p})
+}
+
+func encodeErrorMessage(format string, args ...interface{}) []byte {
+	data, _ := json.Marshal(serverMessage{
+		Version: protocolVersion,
+		Type:    "error",
+		Error:   fmt.Sprintf(format, args...),
+	})
+	return data
+}
+
+// wants reports whether the client's grants and subscriptions let e
+// through.
+func (c *Client) wants(e AlertEvent) bool {
+	if !granted(c.grants, e) {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.subscribed {
+		return true
+	}
+	for _, s := range c.subs {
+		if s.matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMessage applies one client frame and returns the reply to send.
+func (c *Client) handleMessage(data []byte) []byte {
+	var msg clientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return encodeErrorMessage("invalid message: %v", err)
+	}
+	if msg.Version != protocolVersion {
+		return encodeErrorMessage("unsupported protocol version %d", msg.Version)
+	}
+
+	c.mu.Lock()
+	switch msg.Type {
+	case "subscribe":
+		c.subs = append(c.subs, msg.Subscription)
+		c.subscribed = true
+	case "unsubscribe":
+		if len(msg.Alerts) == 0 && len(msg.Labels) == 0 {
+			c.subs = nil
+			break
+		}
+		kept := c.subs[:0]
+		for _, s := range c.subs {
+			if !s.equal(msg.Subscription) {
+				kept = append(kept, s)
+			}
+		}
+		c.subs = kept
+	default:
+		c.mu.Unlock()
+		return encodeErrorMessage("unknown message type %q", msg.Type)
+	}
+	subs := append([]Subscription(nil), c.subs...)
+	c.mu.Unlock()
+
+	reply, _ := json.Marshal(serverMessage{Version: protocolVersion, Type: "subscriptions", Subscriptions: subs})
+	return reply
+}
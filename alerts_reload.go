@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// ---------------- LIVE CONFIG ----------------
+
+// LiveConfig holds the active Config and the sources and notifiers built
+// from it. Readers always see a complete, validated config; a reload either
+// swaps in a new one as a whole or leaves the old one in place.
+type LiveConfig struct {
+	mu         sync.RWMutex
+	cfg        Config
+	sources    *SourceSet
+	dispatcher *Dispatcher
+	silences   *SilenceStore
+}
+
+// NewLiveConfig validates cfg and starts its sources.
+func NewLiveConfig(cfg Config) (*LiveConfig, error) {
+	l := &LiveConfig{silences: NewSilenceStore()}
+	if err := l.Apply(cfg); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Current returns the active config and its sources.
+func (l *LiveConfig) Current() (Config, *SourceSet) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg, l.sources
+}
+
+// Sources returns the active source set.
+func (l *LiveConfig) Sources() *SourceSet {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.sources
+}
+
+// Dispatcher returns the active notification dispatcher.
+func (l *LiveConfig) Dispatcher() *Dispatcher {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.dispatcher
+}
+
+// Silences returns the silence store. It lives as long as the LiveConfig;
+// reloads only replace the silences that came from the file.
+func (l *LiveConfig) Silences() *SilenceStore {
+	return l.silences
+}
+
+// Apply compiles cfg and, if it is valid, makes it the active config.
+// Sources are only restarted when their configuration changed.
+func (l *LiveConfig) Apply(cfg Config) error {
+	if err := compileConfig(&cfg); err != nil {
+		return err
+	}
+	// The previous dispatcher is left running so in-flight retries finish.
+	dispatcher, err := NewDispatcher(cfg)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sources := l.sources
+	if sources == nil || !reflect.DeepEqual(cfg.Sources, l.cfg.Sources) {
+		fresh, err := NewSourceSet(cfg.Sources)
+		if err != nil {
+			return err
+		}
+		if sources != nil {
+			sources.Stop()
+		}
+		sources = fresh
+	}
+
+	l.cfg = cfg
+	l.sources = sources
+	l.dispatcher = dispatcher
+	l.silences.SetStatic(cfg.Silences)
+	return nil
+}
+
+// ---------------- FILE LOADING ----------------
+
+func loadConfig(v *viper.Viper) (Config, error) {
+	var cfg Config
+	if err := v.Unmarshal(&cfg, viper.DecodeHook(configDecodeHook)); err != nil {
+		return Config{}, fmt.Errorf("parse %s: %v", v.ConfigFileUsed(), err)
+	}
+	return cfg, nil
+}
+
+// configDecodeHook turns YAML strings into durations ("5m") and RFC 3339
+// timestamps. It replaces viper's default hooks, so it covers durations too.
+func configDecodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	s, ok := data.(string)
+	if !ok || from.Kind() != reflect.String {
+		return data, nil
+	}
+	switch to {
+	case reflect.TypeOf(time.Duration(0)):
+		return time.ParseDuration(s)
+	case reflect.TypeOf(time.Time{}):
+		return time.Parse(time.RFC3339, s)
+	}
+	return data, nil
+}
+
+// watchConfig re-reads the rules file whenever it changes. An invalid edit is
+// logged and the previous rules stay active.
+func watchConfig(v *viper.Viper, live *LiveConfig) {
+	v.OnConfigChange(func(e fsnotify.Event) {
+		cfg, err := loadConfig(v)
+		if err == nil {
+			err = live.Apply(cfg)
+		}
+		if err != nil {
+			log.Printf("Rejected %s, keeping previous rules: %v", e.Name, err)
+			return
+		}
+		log.Printf("Reloaded %s: %d alerts", e.Name, len(cfg.Alerts))
+	})
+	v.WatchConfig()
+}
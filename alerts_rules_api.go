@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ---------------- RULES API ----------------
+
+// alertDoc is the JSON and YAML form of an Alert.
+type alertDoc struct {
+	Name     string            `json:"name" yaml:"name"`
+	For      string            `json:"for,omitempty" yaml:"for,omitempty"`
+	Severity string            `json:"severity,omitempty" yaml:"severity,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Message  string            `json:"message,omitempty" yaml:"message,omitempty"`
+	Rule     ruleDoc           `json:"rule" yaml:"rule"`
+	Resolve  *ruleDoc          `json:"resolve,omitempty" yaml:"resolve,omitempty"`
+	Missing  string            `json:"missing,omitempty" yaml:"missing,omitempty"`
+	Flapping *flappingDoc      `json:"flapping,omitempty" yaml:"flapping,omitempty"`
+}
+
+type flappingDoc struct {
+	Window    string `json:"window" yaml:"window"`
+	Threshold int    `json:"threshold" yaml:"threshold"`
+}
+
+type ruleDoc struct {
+	And       []ruleDoc `json:"and,omitempty" yaml:"and,omitempty"`
+	Or        []ruleDoc `json:"or,omitempty" yaml:"or,omitempty"`
+	Condition string    `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+func newAlertDoc(a Alert) alertDoc {
+	d := alertDoc{
+		Name:     a.Name,
+		Severity: a.Severity,
+		Labels:   a.Labels,
+		Message:  a.Message,
+		Rule:     newRuleDoc(a.Rule),
+		Missing:  string(a.Missing),
+	}
+	if a.For > 0 {
+		d.For = a.For.String()
+	}
+	if !a.Resolve.empty() {
+		resolve := newRuleDoc(a.Resolve)
+		d.Resolve = &resolve
+	}
+	if a.Flapping.Threshold > 0 {
+		d.Flapping = &flappingDoc{Window: a.Flapping.Window.String(), Threshold: a.Flapping.Threshold}
+	}
+	return d
+}
+
+func newRuleDoc(r Rule) ruleDoc {
+	d := ruleDoc{Condition: r.Condition}
+	for _, sub := range r.And {
+		d.And = append(d.And, newRuleDoc(sub))
+	}
+	for _, sub := range r.Or {
+		d.Or = append(d.Or, newRuleDoc(sub))
+	}
+	return d
+}
+
+func (d alertDoc) alert() (Alert, error) {
+	a := Alert{
+		Name:     d.Name,
+		Severity: d.Severity,
+		Labels:   d.Labels,
+		Message:  d.Message,
+		Rule:     d.Rule.rule(),
+		Missing:  MissingPolicy(d.Missing),
+	}
+	if d.For != "" {
+		f, err := time.ParseDuration(d.For)
+		if err != nil {
+			return Alert{}, fmt.Errorf("for: %v", err)
+		}
+		a.For = f
+	}
+	if d.Resolve != nil {
+		a.Resolve = d.Resolve.rule()
+	}
+	if d.Flapping != nil {
+		w, err := time.ParseDuration(d.Flapping.Window)
+		if err != nil {
+			return Alert{}, fmt.Errorf("flapping.window: %v", err)
+		}
+		a.Flapping = FlappingConfig{Window: w, Threshold: d.Flapping.Threshold}
+	}
+	return a, nil
+}
+
+func (d ruleDoc) rule() Rule {
+	r := Rule{Condition: d.Condition}
+	for _, sub := range d.And {
+		r.And = append(r.And, sub.rule())
+	}
+	for _, sub := range d.Or {
+		r.Or = append(r.Or, sub.rule())
+	}
+	return r
+}
+
+// RulesAPI lets operators manage alert definitions at runtime. Every change
+// is validated, written back to the rules file and applied live.
+type RulesAPI struct {
+	mu   sync.Mutex // serialises edits
+	live *LiveConfig
+	path string
+}
+
+func NewRulesAPI(live *LiveConfig, path string) *RulesAPI {
+	return &RulesAPI{live: live, path: path}
+}
+
+// ServeHTTP handles
+//
+//	GET    /api/rules          list alerts
+//	POST   /api/rules          create an alert
+//	POST   /api/rules/test     evaluate an alert against current metrics
+//	GET    /api/rules/<name>   fetch one alert
+//	PUT    /api/rules/<name>   replace an alert
+//	DELETE /api/rules/<name>   delete an alert
+func (a *RulesAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rules"), "/")
+	cfg, _ := a.live.Current()
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		docs := make([]alertDoc, len(cfg.Alerts))
+		for i, alert := range cfg.Alerts {
+			docs[i] = newAlertDoc(alert)
+		}
+		writeJSON(w, http.StatusOK, docs)
+
+	case name == "" && r.Method == http.MethodPost:
+		alert, ok := decodeAlert(w, r)
+		if !ok {
+			return
+		}
+		a.edit(w, http.StatusCreated, alert, func(alerts []Alert) ([]Alert, error) {
+			if findAlert(alerts, alert.Name) >= 0 {
+				return nil, fmt.Errorf("alert %q already exists", alert.Name)
+			}
+			return append(alerts, alert), nil
+		})
+
+	case name == "test" && r.Method == http.MethodPost:
+		alert, ok := decodeAlert(w, r)
+		if !ok {
+			return
+		}
+		a.test(w, alert)
+
+	case name != "" && r.Method == http.MethodGet:
+		i := findAlert(cfg.Alerts, name)
+		if i < 0 {
+			http.Error(w, "Alert not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, newAlertDoc(cfg.Alerts[i]))
+
+	case name != "" && r.Method == http.MethodPut:
+		alert, ok := decodeAlert(w, r)
+		if !ok {
+			return
+		}
+		a.edit(w, http.StatusOK, alert, func(alerts []Alert) ([]Alert, error) {
+			i := findAlert(alerts, name)
+			if i < 0 {
+				return nil, errNotFound
+			}
+			alerts[i] = alert
+			return alerts, nil
+		})
+
+	case name != "" && r.Method == http.MethodDelete:
+		a.edit(w, http.StatusNoContent, Alert{}, func(alerts []Alert) ([]Alert, error) {
+			i := findAlert(alerts, name)
+			if i < 0 {
+				return nil, errNotFound
+			}
+			return append(alerts[:i], alerts[i+1:]...), nil
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var errNotFound = fmt.Errorf("alert not found")
+
+func decodeAlert(w http.ResponseWriter, r *http.Request) (Alert, bool) {
+	var doc alertDoc
+	if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return Alert{}, false
+	}
+	alert, err := doc.alert()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Alert{}, false
+	}
+	return alert, true
+}
+
+func findAlert(alerts []Alert, name string) int {
+	for i, a := range alerts {
+		if a.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// edit applies change to a deep copy of the current alerts, validates the
+// result, persists it and swaps it in. The live rule trees are never
+// compiled in place: the evaluator reads them concurrently.
+func (a *RulesAPI) edit(w http.ResponseWriter, status int, alert Alert, change func([]Alert) ([]Alert, error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cfg, _ := a.live.Current()
+	current := make([]Alert, len(cfg.Alerts))
+	for i, alert := range cfg.Alerts {
+		alert.Rule = alert.Rule.clone()
+		alert.Resolve = alert.Resolve.clone()
+		current[i] = alert
+	}
+	alerts, err := change(current)
+	if err == errNotFound {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	next := cfg
+	next.Alerts = alerts
+	if err := compileConfig(&next); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := writeAlertsFile(a.path, alerts); err != nil {
+		http.Error(w, "Failed to save rules: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.live.Apply(next); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, newAlertDoc(alert))
+}
+
+// ruleTestResult is the outcome of evaluating one alert instance.
+type ruleTestResult struct {
+	Name   string             `json:"name"`
+	Labels Labels             `json:"labels,omitempty"`
+	Active bool               `json:"active"`
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// test evaluates alert once against the current metrics without touching
+// any alert state. Windowed and anomaly functions have no history here and
+// never hold.
+func (a *RulesAPI) test(w http.ResponseWriter, alert Alert) {
+	cfg := Config{Alerts: []Alert{alert}}
+	if err := compileConfig(&cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	alert = cfg.Alerts[0]
+
+	metrics := a.live.Sources().Snapshot()
+	idx := buildSeriesIndex(metrics)
+	now := time.Now()
+
+	var results []ruleTestResult
+	for _, instance := range idx.instances(alert.Rule.selectors()) {
+		env := &evalEnv{metrics: metrics, index: idx, instance: instance, now: now}
+		labels := Labels(alert.Labels).Merge(instance)
+		results = append(results, ruleTestResult{
+			Name:   renderLabelTemplate(alert.nameTmpl, alert.Name, labels),
+			Labels: instance,
+			Active: evalRule(alert.Rule, env),
+			Values: alert.Rule.values(env),
+		})
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ---------------- YAML WRITE-BACK ----------------
+
+// writeAlertsFile replaces the alerts section of the rules file, keeping
+// the other sections and their comments, and swaps the file in atomically.
+func writeAlertsFile(path string, alerts []Alert) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: top level is not a mapping", path)
+	}
+
+	docs := make([]alertDoc, len(alerts))
+	for i, alert := range alerts {
+		docs[i] = newAlertDoc(alert)
+	}
+	var value yaml.Node
+	if err := value.Encode(docs); err != nil {
+		return err
+	}
+
+	replaced := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "alerts" {
+			root.Content[i+1] = &value
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "alerts"}, &value)
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, out)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const testRulesFile = `# on-call rules
+api:
+  token: s3cret # rotated monthly
+alerts:
+  - name: cpu_high
+    for: 1m
+    rule:
+      condition: cpu > 2
+`
+
+// readRulesFile loads path the way main does.
+func readRulesFile(t *testing.T, path string) Config {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRulesAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(testRulesFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	live, err := NewLiveConfig(readRulesFile(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(live.Sources().Stop)
+	api := NewRulesAPI(live, path)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	names := func(alerts []Alert) string {
+		var out []string
+		for _, a := range alerts {
+			out = append(out, a.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	diskFull := `{"name":"disk_full","severity":"critical","rule":{"or":[{"condition":"disk./.used_pct > 90"},{"and":[{"condition":"memory > 1GiB"},{"condition":"cpu > 1"}]}]}}`
+	if rec := do(http.MethodPost, "/api/rules", diskFull); rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+	saved := readRulesFile(t, path)
+	if got := names(saved.Alerts); got != "cpu_high,disk_full" {
+		t.Fatalf("file alerts = %s", got)
+	}
+	if or := saved.Alerts[1].Rule.Or; len(or) != 2 || len(or[1].And) != 2 || or[1].And[0].Condition != "memory > 1GiB" {
+		t.Errorf("saved rule tree = %+v", saved.Alerts[1].Rule)
+	}
+	if saved.API.Token != "s3cret" {
+		t.Errorf("api section lost: %+v", saved.API)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "# on-call rules") || !strings.Contains(string(data), "# rotated monthly") {
+		t.Errorf("comments lost:\n%s", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("file mode = %v, want 0600", info.Mode().Perm())
+	}
+	if cfg, _ := live.Current(); names(cfg.Alerts) != "cpu_high,disk_full" {
+		t.Errorf("live alerts = %s", names(cfg.Alerts))
+	}
+
+	for _, tt := range []struct {
+		name, method, target, body string
+		status                     int
+	}{
+		{"duplicate", http.MethodPost, "/api/rules", diskFull, http.StatusConflict},
+		{"bad condition", http.MethodPost, "/api/rules", `{"name":"x","rule":{"condition":"cpu >"}}`, http.StatusUnprocessableEntity},
+		{"bad for", http.MethodPost, "/api/rules", `{"name":"x","for":"soon","rule":{"condition":"cpu > 1"}}`, http.StatusBadRequest},
+		{"bad json", http.MethodPost, "/api/rules", `{`, http.StatusBadRequest},
+		{"update missing", http.MethodPut, "/api/rules/nope", `{"name":"nope","rule":{"condition":"cpu > 1"}}`, http.StatusNotFound},
+	} {
+		if rec := do(tt.method, tt.target, tt.body); rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+	if got := names(readRulesFile(t, path).Alerts); got != "cpu_high,disk_full" {
+		t.Errorf("rejected edits changed the file: %s", got)
+	}
+
+	if rec := do(http.MethodPut, "/api/rules/cpu_high", `{"name":"cpu_high","for":"5m","rule":{"condition":"cpu > 4"}}`); rec.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", rec.Code, rec.Body)
+	}
+	saved = readRulesFile(t, path)
+	if a := saved.Alerts[0]; a.For != 5*time.Minute || a.Rule.Condition != "cpu > 4" {
+		t.Errorf("updated alert = %+v", a)
+	}
+
+	var doc alertDoc
+	rec := do(http.MethodGet, "/api/rules/cpu_high", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil || doc.For != "5m0s" || doc.Rule.Condition != "cpu > 4" {
+		t.Errorf("get = %s (%v)", rec.Body, err)
+	}
+
+	if rec := do(http.MethodDelete, "/api/rules/cpu_high", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := names(readRulesFile(t, path).Alerts); got != "disk_full" {
+		t.Errorf("file alerts after delete = %s", got)
+	}
+	if rec := do(http.MethodDelete, "/api/rules/cpu_high", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete: status %d, want 404", rec.Code)
+	}
+
+	var docs []alertDoc
+	json.Unmarshal(do(http.MethodGet, "/api/rules", "").Body.Bytes(), &docs)
+	if len(docs) != 1 || docs[0].Name != "disk_full" {
+		t.Errorf("list = %+v", docs)
+	}
+}
+
+func TestRulesAPIEditWhileEvaluating(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(testRulesFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	live, err := NewLiveConfig(readRulesFile(t, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(live.Sources().Stop)
+	api := NewRulesAPI(live, path)
+
+	tree := `{"name":"%s","rule":{"or":[{"condition":"cpu > 90"},{"and":[{"condition":"memory > 1GiB"},{"condition":"cpu > 1"}]}]}}`
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/rules", strings.NewReader(fmt.Sprintf(tree, "busy"))))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", rec.Code, rec.Body)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ev := NewEvaluator()
+		metrics := map[string]float64{"cpu": 3, "memory": 2 << 30}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cfg, _ := live.Current()
+			ev.Step(cfg, metrics, time.Now())
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(tree, fmt.Sprint("extra", i))
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/rules", strings.NewReader(body)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create %d: status %d: %s", i, rec.Code, rec.Body)
+		}
+	}
+	close(stop)
+	<-done
+}
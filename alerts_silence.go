@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- SILENCES ----------------
+
+// Silence mutes notifications and broadcasts for matching alerts between
+// StartsAt and EndsAt. Alerts keep being evaluated and recorded while muted.
+//
+//	silences:
+//	  - alert: disk_full
+//	    labels: {host: db1}
+//	    starts_at: 2026-10-18T22:00:00Z
+//	    ends_at: 2026-10-19T02:00:00Z
+//	    comment: storage migration
+type Silence struct {
+	ID        string            `mapstructure:"id" json:"id"`
+	Alert     string            `mapstructure:"alert" json:"alert,omitempty"`
+	Labels    map[string]string `mapstructure:"labels" json:"labels,omitempty"`
+	StartsAt  time.Time         `mapstructure:"starts_at" json:"starts_at"`
+	EndsAt    time.Time         `mapstructure:"ends_at" json:"ends_at"`
+	Comment   string            `mapstructure:"comment" json:"comment,omitempty"`
+	CreatedBy string            `mapstructure:"created_by" json:"created_by,omitempty"`
+}
+
+func (s Silence) validate() error {
+	if s.Alert == "" && len(s.Labels) == 0 {
+		return fmt.Errorf("alert or labels is required")
+	}
+	if s.EndsAt.IsZero() {
+		return fmt.Errorf("ends_at is required")
+	}
+	if !s.StartsAt.IsZero() && !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+func (s Silence) activeAt(t time.Time) bool {
+	return !t.Before(s.StartsAt) && t.Before(s.EndsAt)
+}
+
+func (s Silence) matches(e AlertEvent) bool {
+	if s.Alert != "" && !alertNameMatches(s.Alert, e) {
+		return false
+	}
+	for k, v := range s.Labels {
+		if e.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func validateSilences(silences []Silence, errs *ConfigError) {
+	for i, s := range silences {
+		if err := s.validate(); err != nil {
+			errs.add(fmt.Sprintf("silences[%d]", i), "%v", err)
+		}
+	}
+}
+
+// SilenceStore holds the silences from rules.yaml, replaced on every reload,
+// alongside those created through the API, which survive reloads.
+type SilenceStore struct {
+	mu      sync.RWMutex
+	static  []Silence
+	dynamic map[string]Silence
+}
+
+func NewSilenceStore() *SilenceStore {
+	return &SilenceStore{dynamic: make(map[string]Silence)}
+}
+
+// SetStatic replaces the silences that came from the config file.
+func (s *SilenceStore) SetStatic(silences []Silence) {
+	static := make([]Silence, len(silences))
+	for i, sil := range silences {
+		if sil.ID == "" {
+			sil.ID = fmt.Sprintf("config-%d", i)
+		}
+		static[i] = sil
+	}
+
+	s.mu.Lock()
+	s.static = static
+	s.mu.Unlock()
+}
+
+// SilencedBy returns the ID of a silence muting e at time t, or "".
+func (s *SilenceStore) SilencedBy(e AlertEvent, t time.Time) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, sil := range s.static {
+		if sil.activeAt(t) && sil.matches(e) {
+			return sil.ID
+		}
+	}
+	for _, sil := range s.dynamic {
+		if sil.activeAt(t) && sil.matches(e) {
+			return sil.ID
+		}
+	}
+	return ""
+}
+
+// Add stores a new API silence and returns it with its ID filled in.
+func (s *SilenceStore) Add(sil Silence, now time.Time) (Silence, error) {
+	if sil.StartsAt.IsZero() {
+		sil.StartsAt = now
+	}
+	if err := sil.validate(); err != nil {
+		return Silence{}, err
+	}
+	sil.ID = newSilenceID()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dynamic[sil.ID] = sil
+	return sil, nil
+}
+
+// Expire ends an API silence immediately.
+func (s *SilenceStore) Expire(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.dynamic[id]; !ok {
+		return false
+	}
+	delete(s.dynamic, id)
+	return true
+}
+
+// List returns every silence that has not yet ended, config silences first.
+func (s *SilenceStore) List(now time.Time) []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []Silence
+	for _, sil := range s.static {
+		if now.Before(sil.EndsAt) {
+			out = append(out, sil)
+		}
+	}
+
+	var dynamic []Silence
+	for id, sil := range s.dynamic {
+		if !now.Before(sil.EndsAt) {
+			delete(s.dynamic, id)
+			continue
+		}
+		dynamic = append(dynamic, sil)
+	}
+	sort.Slice(dynamic, func(i, j int) bool { return dynamic[i].StartsAt.Before(dynamic[j].StartsAt) })
+	return append(out, dynamic...)
+}
+
+func newSilenceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// heldAlerts remembers, by instance, firing alerts whose notification a
+// silence or inhibit rule held back. Both are only consulted when an alert
+// changes state, so without this an alert muted when it fired would stay
+// quiet for as long as it kept firing.
+type heldAlerts map[string]AlertEvent
+
+// track updates the held alerts with an event from the evaluator.
+func (h heldAlerts) track(e AlertEvent) {
+	switch {
+	case e.State != StateFiring:
+		delete(h, e.Instance)
+	case e.SilencedBy != "" || e.InhibitedBy != "":
+		if _, ok := h[e.Instance]; !ok {
+			h[e.Instance] = e
+		}
+	}
+}
+
+// release returns the held alerts that still fire in active and are no
+// longer suppressed, and forgets them along with those that stopped firing.
+func (h heldAlerts) release(active []ActiveAlert, suppressed func(AlertEvent) bool) []AlertEvent {
+	firing := make(map[string]bool, len(active))
+	for _, a := range active {
+		if a.State == StateFiring {
+			firing[a.Instance] = true
+		}
+	}
+
+	var out []AlertEvent
+	for key, e := range h {
+		if !firing[key] {
+			delete(h, key)
+			continue
+		}
+		if suppressed(e) {
+			continue
+		}
+		delete(h, key)
+		e.SilencedBy, e.InhibitedBy = "", ""
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Instance < out[j].Instance })
+	return out
+}
+
+// ---------------- SILENCE API ----------------
+
+// ServeHTTP handles
+//
+//	GET    /api/silences        list active and upcoming silences
+//	POST   /api/silences        create a silence from a JSON body
+//	DELETE /api/silences/<id>   expire a silence
+func (s *SilenceStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/silences"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.List(time.Now()))
+
+	case r.Method == http.MethodPost && id == "":
+		var sil Silence
+		if err := json.NewDecoder(r.Body).Decode(&sil); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		created, err := s.Add(sil, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	case r.Method == http.MethodDelete && id != "":
+		if !s.Expire(id) {
+			http.Error(w, "Silence not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSilenceMatching(t *testing.T) {
+	now := time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)
+	s := NewSilenceStore()
+	s.SetStatic([]Silence{
+		{Alert: "disk_full", Labels: map[string]string{"host": "db1"}, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+		{Labels: map[string]string{"env": "staging"}, StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)},
+	})
+
+	tests := []struct {
+		name  string
+		event AlertEvent
+		at    time.Time
+		want  string
+	}{
+		{"alert and labels", AlertEvent{Alert: "disk_full", Labels: map[string]string{"host": "db1", "mount": "/"}}, now, "config-0"},
+		{"other host", AlertEvent{Alert: "disk_full", Labels: map[string]string{"host": "db2"}}, now, ""},
+		{"other alert", AlertEvent{Alert: "cpu_high", Labels: map[string]string{"host": "db1"}}, now, ""},
+		{"after the end", AlertEvent{Alert: "disk_full", Labels: map[string]string{"host": "db1"}}, now.Add(time.Hour), ""},
+		{"before the start", AlertEvent{Alert: "cpu_high", Labels: map[string]string{"env": "staging"}}, now, ""},
+		{"labels only", AlertEvent{Alert: "cpu_high", Labels: map[string]string{"env": "staging"}}, now.Add(90 * time.Minute), "config-1"},
+	}
+	for _, tt := range tests {
+		if got := s.SilencedBy(tt.event, tt.at); got != tt.want {
+			t.Errorf("%s: silenced by %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSilenceExpiry(t *testing.T) {
+	now := time.Now()
+	s := NewSilenceStore()
+	e := AlertEvent{Alert: "cpu_high"}
+
+	sil, err := s.Add(Silence{Alert: "cpu_high", EndsAt: now.Add(time.Minute)}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sil.StartsAt.Equal(now) || sil.ID == "" {
+		t.Errorf("added silence = %+v, want an ID and starts_at now", sil)
+	}
+	if got := s.SilencedBy(e, now); got != sil.ID {
+		t.Errorf("silenced by %q, want %q", got, sil.ID)
+	}
+	if got := s.SilencedBy(e, now.Add(time.Minute)); got != "" {
+		t.Errorf("silenced by %q at ends_at, want none", got)
+	}
+	if got := s.List(now.Add(time.Minute)); len(got) != 0 {
+		t.Errorf("ended silences listed: %v", got)
+	}
+
+	sil, _ = s.Add(Silence{Alert: "cpu_high", EndsAt: now.Add(time.Hour)}, now)
+	if !s.Expire(sil.ID) {
+		t.Fatal("Expire returned false for an active silence")
+	}
+	if got := s.SilencedBy(e, now); got != "" {
+		t.Errorf("silenced by %q after expiry", got)
+	}
+	if s.Expire(sil.ID) {
+		t.Error("expired the same silence twice")
+	}
+
+	if _, err := s.Add(Silence{Alert: "cpu_high"}, now); err == nil {
+		t.Error("added a silence without ends_at")
+	}
+	if _, err := s.Add(Silence{EndsAt: now.Add(time.Hour)}, now); err == nil {
+		t.Error("added a silence matching every alert")
+	}
+}
+
+func TestSilenceAPI(t *testing.T) {
+	s := NewSilenceStore()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	ends := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rec := do(http.MethodPost, "/api/silences", `{"alert":"disk_full","ends_at":"`+ends+`","comment":"migration"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: status %d: %s", rec.Code, rec.Body)
+	}
+	var created Silence
+	json.Unmarshal(rec.Body.Bytes(), &created)
+
+	if rec := do(http.MethodPost, "/api/silences", `{"alert":"disk_full"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST without ends_at: status %d, want 400", rec.Code)
+	}
+
+	var listed []Silence
+	json.Unmarshal(do(http.MethodGet, "/api/silences", "").Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Comment != "migration" {
+		t.Errorf("GET = %+v, want the created silence", listed)
+	}
+
+	if rec := do(http.MethodDelete, "/api/silences/"+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE: status %d, want 204", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/silences/"+created.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE: status %d, want 404", rec.Code)
+	}
+}
+
+func TestHeldAlertsReleasedWhenSilenceEnds(t *testing.T) {
+	now := time.Now()
+	s := NewSilenceStore()
+	sil, err := s.Add(Silence{Alert: "cpu_high", EndsAt: now.Add(time.Hour)}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(Silence{Alert: "disk_full", EndsAt: now.Add(time.Minute)}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	held := make(heldAlerts)
+	for _, name := range []string{"cpu_high", "disk_full", "load_high"} {
+		e := AlertEvent{Alert: name, Instance: name, State: StateFiring, Previous: StatePending, Time: now}
+		e.SilencedBy = s.SilencedBy(e, now)
+		held.track(e)
+	}
+	if len(held) != 2 {
+		t.Fatalf("held %d alerts, want the 2 silenced ones", len(held))
+	}
+	active := []ActiveAlert{
+		{Name: "cpu_high", Instance: "cpu_high", State: StateFiring},
+		{Name: "disk_full", Instance: "disk_full", State: StateFiring},
+		{Name: "load_high", Instance: "load_high", State: StateFiring},
+	}
+	release := func(at time.Time) []AlertEvent {
+		return held.release(active, func(e AlertEvent) bool { return s.SilencedBy(e, at) != "" })
+	}
+
+	if got := release(now); len(got) != 0 {
+		t.Errorf("released %v while silenced", got)
+	}
+
+	// disk_full's silence runs out; cpu_high's is deleted.
+	got := release(now.Add(2 * time.Minute))
+	if len(got) != 1 || got[0].Alert != "disk_full" || got[0].SilencedBy != "" || got[0].State != StateFiring {
+		t.Errorf("released %+v after the silence ended, want disk_full firing", got)
+	}
+	s.Expire(sil.ID)
+	if got := release(now.Add(3 * time.Minute)); len(got) != 1 || got[0].Alert != "cpu_high" {
+		t.Errorf("released %+v after the silence was deleted, want cpu_high", got)
+	}
+	if got := release(now.Add(4 * time.Minute)); len(got) != 0 || len(held) != 0 {
+		t.Errorf("released %v again, %d still held", got, len(held))
+	}
+
+	// An alert that resolves while silenced is never sent as firing.
+	e := AlertEvent{Alert: "cpu_high", Instance: "cpu_high", State: StateFiring, Previous: StatePending, SilencedBy: "x"}
+	held.track(e)
+	e.State, e.Previous = StateResolved, StateFiring
+	held.track(e)
+	if len(held) != 0 {
+		t.Errorf("resolved alert still held")
+	}
+	held.track(AlertEvent{Alert: "gone", Instance: "gone", State: StateFiring, SilencedBy: "x"})
+	if got := release(now); len(got) != 0 || len(held) != 0 {
+		t.Errorf("alert no longer firing released %v or kept", got)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- METRIC SOURCES ----------------
+
+// MetricSource produces a flat set of samples each time it is collected.
+type MetricSource interface {
+	Collect(ctx context.Context) (map[string]float64, error)
+}
+
+// SourceConfig is one entry of the `sources` section in rules.yaml:
+//
+//	sources:
+//	  - name: host
+//	    type: system
+//	  - name: app
+//	    type: prometheus
+//	    url: http://127.0.0.1:9100/metrics
+//	    interval: 15s
+//	    prefix: app
+//	  - name: batch
+//	    type: json
+//	    path: /var/run/batch/metrics.json
+//	  - name: procs
+//	    type: process
+//	    processes: [{name: nginx, process: nginx}]
+//	  - name: containers
+//	    type: cgroup
+//	    cgroups: [{name: nginx, path: system.slice/nginx.service}]
+//	  - name: nginx_log
+//	    type: log
+//	    path: /var/log/nginx/access.log
+//	    patterns: [{name: nginx_5xx, regex: '" 5\d\d '}]
+type SourceConfig struct {
+	Name     string        `mapstructure:"name"`
+	Type     string        `mapstructure:"type"`
+	Interval time.Duration `mapstructure:"interval"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Prefix   string        `mapstructure:"prefix"`
+	Path     string        `mapstructure:"path"`
+	URL      string        `mapstructure:"url"`
+
+	Processes []ProcessMatch  `mapstructure:"processes"` // process sources only
+	Cgroups   []CgroupMatch   `mapstructure:"cgroups"`   // cgroup sources only
+	Patterns  []LogPattern    `mapstructure:"patterns"`  // log sources only
+	Windows   []time.Duration `mapstructure:"windows"`   // log sources only
+}
+
+const defaultSourceInterval = 5 * time.Second
+
+type sourceFactory func(sc SourceConfig) (MetricSource, error)
+
+var sourceTypes = map[string]sourceFactory{
+	"system":     func(SourceConfig) (MetricSource, error) { return systemSource{}, nil },
+	"prometheus": newPrometheusSource,
+	"json":       newJSONSource,
+	"process":    newProcessSource,
+	"cgroup":     newCgroupSource,
+	"log":        newLogSource,
+}
+
+// RegisterSourceType makes a new source type available to rules.yaml.
+func RegisterSourceType(name string, f sourceFactory) {
+	sourceTypes[name] = f
+}
+
+// defaultSources is used when rules.yaml has no `sources` section.
+var defaultSources = []SourceConfig{{Name: "system", Type: "system"}}
+
+func newSource(sc SourceConfig) (MetricSource, error) {
+	f, ok := sourceTypes[sc.Type]
+	if !ok {
+		return nil, fmt.Errorf("source %q: unknown type %q", sc.Name, sc.Type)
+	}
+	src, err := f(sc)
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %v", sc.Name, err)
+	}
+	return src, nil
+}
+
+func validateSources(sources []SourceConfig) error {
+	seen := make(map[string]bool, len(sources))
+	for i, sc := range sources {
+		if sc.Name == "" {
+			return fmt.Errorf("sources[%d]: name is required", i)
+		}
+		if seen[sc.Name] {
+			return fmt.Errorf("sources[%d]: duplicate name %q", i, sc.Name)
+		}
+		seen[sc.Name] = true
+		if _, ok := sourceTypes[sc.Type]; !ok {
+			return fmt.Errorf("sources[%d]: unknown type %q", i, sc.Type)
+		}
+	}
+	return nil
+}
+
+// ---------------- SOURCE SET ----------------
+
+// SourceSet runs every configured source on its own interval and keeps the
+// latest successful result of each so the evaluator can merge them.
+type SourceSet struct {
+	mu      sync.RWMutex
+	order   []string
+	latest  map[string]map[string]float64
+	sources map[string]MetricSource
+	cancel  context.CancelFunc
+}
+
+func NewSourceSet(configs []SourceConfig) (*SourceSet, error) {
+	if len(configs) == 0 {
+		configs = defaultSources
+	}
+	if err := validateSources(configs); err != nil {
+		return nil, err
+	}
+
+	s := &SourceSet{
+		latest:  make(map[string]map[string]float64),
+		sources: make(map[string]MetricSource),
+	}
+	for _, sc := range configs {
+		src, err := newSource(sc)
+		if err != nil {
+			return nil, err
+		}
+		s.order = append(s.order, sc.Name)
+		s.sources[sc.Name] = src
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, sc := range configs {
+		go s.run(ctx, sc, s.sources[sc.Name])
+	}
+	return s, nil
+}
+
+// Stop ends every collection goroutine and closes sources that hold
+// resources open, such as tailed logs.
+func (s *SourceSet) Stop() {
+	s.cancel()
+	for _, src := range s.sources {
+		if c, ok := src.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// Source returns the named source, or nil.
+func (s *SourceSet) Source(name string) MetricSource {
+	return s.sources[name]
+}
+
+func (s *SourceSet) run(ctx context.Context, sc SourceConfig, src MetricSource) {
+	interval := sc.Interval
+	if interval <= 0 {
+		interval = defaultSourceInterval
+	}
+	timeout := sc.Timeout
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cctx, cancel := context.WithTimeout(ctx, timeout)
+		metrics, err := src.Collect(cctx)
+		cancel()
+
+		s.mu.Lock()
+		if err != nil {
+			log.Printf("source %s: %v", sc.Name, err)
+			delete(s.latest, sc.Name)
+		} else {
+			s.latest[sc.Name] = prefixMetrics(sc.Prefix, metrics)
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Snapshot merges the latest samples of every source. Sources later in the
+// config win when two produce the same metric name.
+func (s *SourceSet) Snapshot() map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	merged := make(map[string]float64)
+	for _, name := range s.order {
+		for k, v := range s.latest[name] {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func prefixMetrics(prefix string, metrics map[string]float64) map[string]float64 {
+	if prefix == "" {
+		return metrics
+	}
+	out := make(map[string]float64, len(metrics))
+	for k, v := range metrics {
+		out[prefix+"."+k] = v
+	}
+	return out
+}
+
+// ---------------- SYSTEM ----------------
+
+type systemSource struct{}
+
+func (systemSource) Collect(ctx context.Context) (map[string]float64, error) {
+	return getSystemMetrics()
+}
+
+// ---------------- PROMETHEUS ----------------
+
+// prometheusSource reads the Prometheus text exposition format from a file
+// or a local HTTP endpoint. Labeled samples are kept as labeled series and
+// also folded into a plain name in label name order, so
+// `http_requests_total{code="500",method="get"}` is reachable as
+// `http_requests_total.500.get` too.
+type prometheusSource struct {
+	path string
+	url  string
+}
+
+func newPrometheusSource(sc SourceConfig) (MetricSource, error) {
+	if (sc.Path == "") == (sc.URL == "") {
+		return nil, fmt.Errorf("exactly one of path or url is required")
+	}
+	return &prometheusSource{path: sc.Path, url: sc.URL}, nil
+}
+
+func (p *prometheusSource) Collect(ctx context.Context) (map[string]float64, error) {
+	r, err := openSource(ctx, p.path, p.url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return parsePrometheusText(r)
+}
+
+func parsePrometheusText(r io.Reader) (map[string]float64, error) {
+	metrics := make(map[string]float64)
+	sc := bufio.NewScanner(r)
+	line := 0
+
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, labels, rest, err := splitPrometheusSample(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		fields := strings.Fields(rest)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected value and optional timestamp", line)
+		}
+		v, err := parsePrometheusValue(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		metrics[flattenLabels(name, labels)] = v
+		if len(labels) > 0 {
+			metrics[seriesKey(name, labels)] = v
+		}
+	}
+	return metrics, sc.Err()
+}
+
+func splitPrometheusSample(text string) (string, map[string]string, string, error) {
+	i := strings.IndexAny(text, "{ \t")
+	if i < 0 {
+		return "", nil, "", fmt.Errorf("missing value")
+	}
+	name := text[:i]
+	if text[i] != '{' {
+		return name, nil, text[i:], nil
+	}
+
+	labels := make(map[string]string)
+	j := i + 1
+	for {
+		for j < len(text) && (text[j] == ' ' || text[j] == ',') {
+			j++
+		}
+		if j >= len(text) {
+			return "", nil, "", fmt.Errorf("unterminated label set")
+		}
+		if text[j] == '}' {
+			return name, labels, text[j+1:], nil
+		}
+
+		eq := strings.IndexByte(text[j:], '=')
+		if eq < 0 || j+eq+1 >= len(text) || text[j+eq+1] != '"' {
+			return "", nil, "", fmt.Errorf("malformed label")
+		}
+		key := strings.TrimSpace(text[j : j+eq])
+		j += eq + 2
+
+		var val strings.Builder
+		for ; j < len(text) && text[j] != '"'; j++ {
+			if text[j] == '\\' && j+1 < len(text) {
+				j++
+				if text[j] == 'n' {
+					val.WriteByte('\n')
+					continue
+				}
+			}
+			val.WriteByte(text[j])
+		}
+		if j >= len(text) {
+			return "", nil, "", fmt.Errorf("unterminated label value")
+		}
+		j++
+		labels[key] = val.String()
+	}
+}
+
+func parsePrometheusValue(s string) (float64, error) {
+	switch s {
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func flattenLabels(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{name}
+	for _, k := range keys {
+		parts = append(parts, sanitizeMetricSegment(labels[k]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// sanitizeMetricSegment maps characters a condition cannot reference to "_".
+func sanitizeMetricSegment(s string) string {
+	if s == "" {
+		return "_"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if !isIdentChar(c) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// ---------------- JSON ----------------
+
+// jsonSource reads a flat JSON object of numbers. With a path or url it is
+// polled; with neither it only holds what was last POSTed to /push/<name>,
+// which needs a token granting the push resource.
+type jsonSource struct {
+	path string
+	url  string
+
+	mu     sync.RWMutex
+	pushed map[string]float64
+}
+
+func newJSONSource(sc SourceConfig) (MetricSource, error) {
+	if sc.Path != "" && sc.URL != "" {
+		return nil, fmt.Errorf("path and url are mutually exclusive")
+	}
+	return &jsonSource{path: sc.Path, url: sc.URL}, nil
+}
+
+func (j *jsonSource) Collect(ctx context.Context) (map[string]float64, error) {
+	if j.path == "" && j.url == "" {
+		j.mu.RLock()
+		defer j.mu.RUnlock()
+		out := make(map[string]float64, len(j.pushed))
+		for k, v := range j.pushed {
+			out[k] = v
+		}
+		return out, nil
+	}
+
+	r, err := openSource(ctx, j.path, j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return decodeJSONMetrics(r)
+}
+
+// ServeHTTP accepts pushed samples for push-mode JSON sources.
+func (j *jsonSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	metrics, err := decodeJSONMetrics(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j.mu.Lock()
+	j.pushed = metrics
+	j.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeJSONMetrics accepts nested objects and joins their keys with dots,
+// so {"queue": {"depth": 3}} becomes queue.depth.
+func decodeJSONMetrics(r io.Reader) (map[string]float64, error) {
+	var raw map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]float64)
+	flattenJSON("", raw, metrics)
+	return metrics, nil
+}
+
+func flattenJSON(prefix string, v interface{}, out map[string]float64) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range t {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenJSON(key, sub, out)
+		}
+	case float64:
+		out[prefix] = t
+	case bool:
+		out[prefix] = boolFloat(t)
+	}
+}
+
+// pushHandler serves /push/<name> for every push-mode JSON source.
+// current is consulted per request so reloaded sources are picked up.
+func pushHandler(current func() *SourceSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/push/")
+		js, ok := current().Source(name).(*jsonSource)
+		if !ok || js.path != "" || js.url != "" {
+			http.NotFound(w, r)
+			return
+		}
+		js.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- HELPERS ----------------
+
+func openSource(ctx context.Context, path, url string) (io.ReadCloser, error) {
+	if path != "" {
+		return os.Open(path)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
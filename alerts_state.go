@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- ALERT STATE ----------------
+
+type AlertState string
+
+const (
+	StateInactive AlertState = "inactive"
+	StatePending  AlertState = "pending"
+	StateFiring   AlertState = "firing"
+	StateResolved AlertState = "resolved"
+)
+
+// alertStatus is the evaluator's memory of a single alert between ticks.
+type alertStatus struct {
+	alert    string // definition name
+	instance Labels // series labels, nil for unlabeled rules
+	name     string // rendered instance name
+	labels   Labels // alert labels merged with instance labels
+
+	State      AlertState
+	ActiveAt   time.Time // first tick the rule held in the current episode
+	FiredAt    time.Time
+	ResolvedAt time.Time
+
+	lastActive bool        // rule result of the previous tick
+	missing    bool        // the rule could not be decided for lack of metrics
+	noData     bool        // missing under the alert missing policy
+	flips      []time.Time // changes of the rule result within the flapping window
+	flapping   bool
+}
+
+// AlertEvent is emitted whenever an alert changes state.
+type AlertEvent struct {
+	Alert       string
+	Instance    string // definition name and series labels, stable across label changes
+	Severity    string
+	Labels      map[string]string
+	Message     string
+	Rule        string
+	Values      map[string]float64 // finite metrics referenced by the rule at Time
+	SilencedBy  string             // ID of the silence muting this event, if any
+	InhibitedBy string             // firing alert suppressing this event, if any
+	State       AlertState
+	Previous    AlertState
+	ActiveAt    time.Time
+	FiredAt     time.Time
+	ResolvedAt  time.Time
+	Time        time.Time
+}
+
+func (e AlertEvent) String() string {
+	return fmt.Sprintf("%s %s", strings.ToUpper(string(e.State)), e.Alert)
+}
+
+// Evaluator runs the pending -> firing -> resolved state machine for every
+// alert in a Config. It is driven by an explicit clock so the same code can
+// be used live and against recorded data.
+type Evaluator struct {
+	mu        sync.Mutex
+	states    map[string]*alertStatus
+	history   *MetricHistory
+	baselines *Baselines
+}
+
+func NewEvaluator() *Evaluator {
+	return &Evaluator{
+		states:    make(map[string]*alertStatus),
+		history:   NewMetricHistory(),
+		baselines: NewBaselines(),
+	}
+}
+
+// Step evaluates every alert against metrics at time now and returns the
+// state transitions that happened. Alerts whose state did not change produce
+// no event. An alert over labeled series is tracked per instance; an
+// instance whose series disappear is treated as no longer matching, unless
+// its rule uses absent() or it has a missing policy, in which case it is
+// evaluated as usual.
+func (e *Evaluator) Step(cfg Config, metrics map[string]float64, now time.Time) []AlertEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var events []AlertEvent
+	seen := make(map[string]bool, len(cfg.Alerts))
+
+	idx := buildSeriesIndex(metrics)
+	e.history.Record(cfg.windows, idx, metrics, now)
+	e.baselines.Record(cfg.anomalies, idx, metrics, now)
+
+	for _, alert := range cfg.Alerts {
+		seen[alert.Name] = true
+		present := make(map[string]bool)
+
+		for _, instance := range idx.instances(alert.Rule.selectors()) {
+			key := instanceKey(alert.Name, instance)
+			present[key] = true
+
+			env := &evalEnv{metrics: metrics, index: idx, instance: instance, history: e.history, baselines: e.baselines, now: now}
+			if ev, ok := e.observe(alert, key, instance, env, true); ok {
+				events = append(events, ev)
+			}
+		}
+
+		evalVanished := alert.Rule.usesAbsent() || (alert.Missing != "" && alert.Missing != MissingOK)
+		for key, st := range e.states {
+			if st.alert != alert.Name || present[key] {
+				continue
+			}
+			env := &evalEnv{metrics: metrics, index: idx, instance: st.instance, history: e.history, baselines: e.baselines, now: now}
+			if ev, ok := e.observe(alert, key, st.instance, env, evalVanished); ok {
+				events = append(events, ev)
+			}
+			if st.State == StateInactive || st.State == StateResolved {
+				delete(e.states, key)
+			}
+		}
+	}
+
+	// Forget alerts that are no longer configured.
+	for key, st := range e.states {
+		if !seen[st.alert] {
+			delete(e.states, key)
+		}
+	}
+
+	return events
+}
+
+func instanceKey(alert string, instance Labels) string {
+	return alert + instance.Key()
+}
+
+// observe evaluates one instance, feeds the result into its state machine
+// and returns the resulting event, if the state changed. With evaluate
+// false the rule is taken not to hold.
+func (e *Evaluator) observe(alert Alert, key string, instance Labels, env *evalEnv, evaluate bool) (AlertEvent, bool) {
+	st, ok := e.states[key]
+	if !ok {
+		st = &alertStatus{State: StateInactive, alert: alert.Name, instance: instance}
+		e.states[key] = st
+	}
+
+	active := false
+	if evaluate {
+		active = e.condition(st, alert, env)
+	}
+
+	prev, wasFlapping := st.State, st.flapping
+	if !e.flap(st, alert, active, env.now) {
+		return AlertEvent{}, false
+	}
+
+	labels := Labels(alert.Labels).Merge(instance)
+	if alert.Severity != "" && labels["severity"] == "" {
+		labels["severity"] = alert.Severity
+	}
+	if st.noData {
+		labels["nodata"] = "true"
+	}
+	if st.flapping {
+		labels["flapping"] = "true"
+	} else if wasFlapping {
+		log.Printf("alert %s%s stopped flapping", alert.Name, instance.Key())
+	}
+	labels["alertname"] = alert.Name
+	st.labels = labels
+	st.name = renderLabelTemplate(alert.nameTmpl, alert.Name, labels)
+	return AlertEvent{
+		Alert:      st.name,
+		Instance:   key,
+		Severity:   alert.Severity,
+		Labels:     labels,
+		Message:    renderLabelTemplate(alert.messageTmpl, alert.Message, labels),
+		Rule:       alert.Rule.String(),
+		Values:     alert.Rule.values(env),
+		State:      st.State,
+		Previous:   prev,
+		ActiveAt:   st.ActiveAt,
+		FiredAt:    st.FiredAt,
+		ResolvedAt: st.ResolvedAt,
+		Time:       env.now,
+	}, true
+}
+
+// alertNameMatches reports whether name refers to e, either by its rendered
+// name or by the name of the alert definition it came from.
+func alertNameMatches(name string, e AlertEvent) bool {
+	return name == e.Alert || name == e.Labels["alertname"]
+}
+
+// condition decides whether the alert holds for one instance. Once firing,
+// an alert with a resolve rule holds until that rule does; while pending
+// it must keep meeting its own rule. Missing metrics
+// are handled by the alert's missing policy.
+func (e *Evaluator) condition(st *alertStatus, alert Alert, env *evalEnv) bool {
+	var active, missing bool
+	if !alert.Resolve.empty() && st.State == StateFiring {
+		var resolved bool
+		resolved, missing = evalRuleData(alert.Resolve, env)
+		active = !resolved
+	} else {
+		active, missing = evalRuleData(alert.Rule, env)
+	}
+
+	if missing && !st.missing && len(st.instance) == 0 {
+		log.Printf("alert %s: metrics missing, applying missing policy %q", alert.Name, alert.Missing)
+	}
+	st.missing = missing
+	st.noData = false
+	if missing {
+		switch alert.Missing {
+		case MissingFiring:
+			active = true
+		case MissingKeep:
+			active = st.lastActive
+		case MissingAlert:
+			active = true
+			st.noData = true
+		default:
+			active = false
+		}
+	}
+	return active
+}
+
+// flap tracks how often the rule result changes and, while the alert is
+// flapping, freezes its state instead of following every change. It
+// reports whether the state or the flapping tag changed.
+func (e *Evaluator) flap(st *alertStatus, alert Alert, active bool, now time.Time) bool {
+	f := alert.Flapping
+	changed := active != st.lastActive
+	st.lastActive = active
+	if f.Threshold <= 0 {
+		return e.transition(st, alert, active, now)
+	}
+
+	if changed {
+		st.flips = append(st.flips, now)
+	}
+	kept := st.flips[:0]
+	for _, t := range st.flips {
+		if now.Sub(t) < f.Window {
+			kept = append(kept, t)
+		}
+	}
+	st.flips = kept
+
+	wasFlapping := st.flapping
+	st.flapping = len(st.flips) >= f.Threshold
+	if !st.flapping {
+		// Leaving the flapping state always produces an event, so the tag
+		// is cleared downstream.
+		return e.transition(st, alert, active, now) || wasFlapping
+	}
+
+	if !wasFlapping {
+		log.Printf("alert %s%s is flapping: %d changes in %s", alert.Name, st.instance.Key(), len(st.flips), f.Window)
+	}
+	return !wasFlapping
+}
+
+// transition applies one observation to st and reports whether the state changed.
+func (e *Evaluator) transition(st *alertStatus, alert Alert, active bool, now time.Time) bool {
+	switch st.State {
+	case StateInactive, StateResolved:
+		if !active {
+			return false
+		}
+		st.ActiveAt = now
+		st.FiredAt = time.Time{}
+		st.ResolvedAt = time.Time{}
+		if alert.For <= 0 {
+			st.State = StateFiring
+			st.FiredAt = now
+		} else {
+			st.State = StatePending
+		}
+		return true
+
+	case StatePending:
+		if !active {
+			st.State = StateInactive
+			st.ActiveAt = time.Time{}
+			return true
+		}
+		if now.Sub(st.ActiveAt) >= alert.For {
+			st.State = StateFiring
+			st.FiredAt = now
+			return true
+		}
+		return false
+
+	case StateFiring:
+		if active {
+			return false
+		}
+		st.State = StateResolved
+		st.ResolvedAt = now
+		return true
+	}
+
+	return false
+}
+
+// Active returns every pending or firing alert instance.
+func (e *Evaluator) Active() []ActiveAlert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var out []ActiveAlert
+	for _, st := range e.states {
+		if st.State == StatePending || st.State == StateFiring {
+			out = append(out, ActiveAlert{Name: st.name, Instance: instanceKey(st.alert, st.instance), Labels: st.labels, State: st.State})
+		}
+	}
+	return out
+}
+
+// State returns the current state of the named alert instance.
+func (e *Evaluator) State(name string, instance Labels) AlertState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if st, ok := e.states[instanceKey(name, instance)]; ok {
+		return st.State
+	}
+	return StateInactive
+}
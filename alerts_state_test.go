@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+// stateStep is one tick of a state machine test: the metrics seen at
+// minute t and the state the alert instance should be in afterwards.
+// event is the transition Step should report, "" for none.
+type stateStep struct {
+	t       int
+	metrics map[string]float64
+	state   AlertState
+	event   AlertState
+}
+
+func cpuAt(v float64) map[string]float64 {
+	return map[string]float64{"cpu": v}
+}
+
+func TestEvaluatorStateMachine(t *testing.T) {
+	tests := []struct {
+		name  string
+		alert Alert
+		steps []stateStep
+	}{
+		{
+			name:  "fires at once without for",
+			alert: Alert{Name: "cpu_high", Rule: Rule{Condition: "cpu > 2"}},
+			steps: []stateStep{
+				{0, cpuAt(1), StateInactive, ""},
+				{1, cpuAt(3), StateFiring, StateFiring},
+				{2, cpuAt(3), StateFiring, ""},
+				{3, cpuAt(1), StateResolved, StateResolved},
+				{4, cpuAt(1), StateResolved, ""},
+			},
+		},
+		{
+			name:  "pending until for has passed",
+			alert: Alert{Name: "cpu_high", For: 2 * time.Minute, Rule: Rule{Condition: "cpu > 2"}},
+			steps: []stateStep{
+				{0, cpuAt(3), StatePending, StatePending},
+				{1, cpuAt(3), StatePending, ""},
+				{2, cpuAt(3), StateFiring, StateFiring},
+				{3, cpuAt(1), StateResolved, StateResolved},
+				{4, cpuAt(3), StatePending, StatePending},
+			},
+		},
+		{
+			name:  "pending falls back to inactive",
+			alert: Alert{Name: "cpu_high", For: 5 * time.Minute, Rule: Rule{Condition: "cpu > 2"}},
+			steps: []stateStep{
+				{0, cpuAt(3), StatePending, StatePending},
+				{1, cpuAt(1), StateInactive, StateInactive},
+				{2, cpuAt(3), StatePending, StatePending},
+				{6, cpuAt(3), StatePending, ""},
+				{7, cpuAt(3), StateFiring, StateFiring},
+			},
+		},
+		{
+			name:  "missing metrics do not hold by default",
+			alert: Alert{Name: "cpu_high", Rule: Rule{Condition: "cpu > 2"}},
+			steps: []stateStep{
+				{0, cpuAt(3), StateFiring, StateFiring},
+				{1, map[string]float64{}, StateResolved, StateResolved},
+			},
+		},
+		{
+			name:  "missing keep holds the last result",
+			alert: Alert{Name: "cpu_high", Missing: MissingKeep, Rule: Rule{Condition: "cpu > 2"}},
+			steps: []stateStep{
+				{0, cpuAt(3), StateFiring, StateFiring},
+				{1, map[string]float64{}, StateFiring, ""},
+				{2, cpuAt(1), StateResolved, StateResolved},
+			},
+		},
+		{
+			name:  "resolve rule keeps the alert active",
+			alert: Alert{Name: "cpu_high", Rule: Rule{Condition: "cpu > 90"}, Resolve: Rule{Condition: "cpu < 80"}},
+			steps: []stateStep{
+				{0, cpuAt(95), StateFiring, StateFiring},
+				{1, cpuAt(85), StateFiring, ""},
+				{2, cpuAt(75), StateResolved, StateResolved},
+				{3, cpuAt(85), StateResolved, ""},
+			},
+		},
+		{
+			name: "resolve rule does not hold a pending alert",
+			alert: Alert{Name: "cpu_high", For: 2 * time.Minute, Rule: Rule{Condition: "cpu > 90"},
+				Resolve: Rule{Condition: "cpu < 80"}},
+			steps: []stateStep{
+				{0, cpuAt(95), StatePending, StatePending},
+				{1, cpuAt(85), StateInactive, StateInactive},
+				{2, cpuAt(95), StatePending, StatePending},
+				{4, cpuAt(95), StateFiring, StateFiring},
+				{5, cpuAt(85), StateFiring, ""},
+			},
+		},
+		{
+			name: "flapping freezes the state",
+			alert: Alert{Name: "cpu_high", For: time.Hour, Rule: Rule{Condition: "cpu > 2"},
+				Flapping: FlappingConfig{Window: 10 * time.Minute, Threshold: 3}},
+			steps: []stateStep{
+				{0, cpuAt(3), StatePending, StatePending},
+				{1, cpuAt(1), StateInactive, StateInactive},
+				{2, cpuAt(3), StateInactive, StateInactive}, // tagged flapping
+				{3, cpuAt(1), StateInactive, ""},
+				{4, cpuAt(3), StateInactive, ""},
+			},
+		},
+	}
+
+	start := time.Unix(1700000000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Alerts: []Alert{tt.alert}}
+			if err := compileConfig(&cfg); err != nil {
+				t.Fatal(err)
+			}
+			ev := NewEvaluator()
+			for _, s := range tt.steps {
+				events := ev.Step(cfg, s.metrics, start.Add(time.Duration(s.t)*time.Minute))
+				var got AlertState
+				if len(events) > 1 {
+					t.Fatalf("t=%d: %d events, want at most 1", s.t, len(events))
+				}
+				if len(events) == 1 {
+					got = events[0].State
+				}
+				if got != s.event {
+					t.Errorf("t=%d: event %q, want %q", s.t, got, s.event)
+				}
+				if st := ev.State(tt.alert.Name, nil); st != s.state {
+					t.Errorf("t=%d: state %s, want %s", s.t, st, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluatorInstances(t *testing.T) {
+	cfg := Config{Alerts: []Alert{{Name: "disk_full", For: time.Minute, Rule: Rule{Condition: "disk.used_pct > 90"}}}}
+	if err := compileConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	root, vars := Labels{"mount": "/"}, Labels{"mount": "/var"}
+	ev := NewEvaluator()
+	start := time.Unix(1700000000, 0)
+
+	step := func(minute int, metrics map[string]float64) []AlertEvent {
+		return ev.Step(cfg, metrics, start.Add(time.Duration(minute)*time.Minute))
+	}
+
+	events := step(0, map[string]float64{seriesKey("disk.used_pct", root): 95, seriesKey("disk.used_pct", vars): 50})
+	if len(events) != 1 || events[0].Labels["mount"] != "/" || events[0].State != StatePending {
+		t.Fatalf("t=0: events %v, want / pending", events)
+	}
+	if events[0].Instance != instanceKey("disk_full", root) {
+		t.Errorf("instance = %q, want %q", events[0].Instance, instanceKey("disk_full", root))
+	}
+
+	step(1, map[string]float64{seriesKey("disk.used_pct", root): 95, seriesKey("disk.used_pct", vars): 95})
+	if got := ev.State("disk_full", root); got != StateFiring {
+		t.Errorf("/ is %s, want firing", got)
+	}
+	if got := ev.State("disk_full", vars); got != StatePending {
+		t.Errorf("/var is %s, want pending", got)
+	}
+
+	// / vanishes: it resolves and is forgotten.
+	events = step(2, map[string]float64{seriesKey("disk.used_pct", vars): 95})
+	var resolved bool
+	for _, e := range events {
+		if e.Labels["mount"] == "/" && e.State == StateResolved && e.Previous == StateFiring {
+			resolved = true
+		}
+	}
+	if !resolved {
+		t.Errorf("t=2: events %v, want / resolved", events)
+	}
+	if got := ev.State("disk_full", root); got != StateInactive {
+		t.Errorf("/ is %s after vanishing, want inactive", got)
+	}
+	if got := ev.State("disk_full", vars); got != StateFiring {
+		t.Errorf("/var is %s, want firing", got)
+	}
+}
+
+func TestEventValuesSkipNonFinite(t *testing.T) {
+	cfg := Config{Alerts: []Alert{{Name: "busy", Rule: Rule{Condition: "cpu > 2 or load1 > 1 or swap > 1"}}}}
+	if err := compileConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	metrics := map[string]float64{"cpu": math.NaN(), "load1": 5, "swap": math.Inf(1)}
+	events := NewEvaluator().Step(cfg, metrics, time.Unix(1700000000, 0))
+	if len(events) != 1 {
+		t.Fatalf("%d events, want 1", len(events))
+	}
+	if v := events[0].Values; len(v) != 1 || v["load1"] != 5 {
+		t.Errorf("values = %v, want only load1", v)
+	}
+	if _, err := encodeAlertMessage(events[0]); err != nil {
+		t.Errorf("encodeAlertMessage: %v", err)
+	}
+	if _, err := json.Marshal(notifyPayload(AlertGroup{Events: events})); err != nil {
+		t.Errorf("notify payload: %v", err)
+	}
+}
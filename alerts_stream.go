@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- REPLAY BUFFER ----------------
+
+const (
+	replaySize         = 1024
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+type streamEvent struct {
+	seq   uint64
+	event AlertEvent
+}
+
+// replayBuffer keeps the most recent broadcasts so SSE and long-poll
+// clients can resume where they left off. Event IDs are "<boot>-<seq>", so
+// an ID handed out by an earlier process is recognised as unknown rather
+// than silently matching a different event.
+type replayBuffer struct {
+	mu     sync.Mutex
+	boot   string
+	events []streamEvent // oldest first, at most replaySize
+	next   uint64
+	wake   chan struct{} // closed and replaced on every append
+}
+
+func newReplayBuffer() *replayBuffer {
+	return &replayBuffer{
+		boot: strconv.FormatInt(time.Now().UnixNano(), 36),
+		next: 1,
+		wake: make(chan struct{}),
+	}
+}
+
+func (b *replayBuffer) append(e AlertEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.events) == replaySize {
+		b.events = append(b.events[:0], b.events[1:]...)
+	}
+	b.events = append(b.events, streamEvent{seq: b.next, event: e})
+	b.next++
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+func (b *replayBuffer) id(seq uint64) string {
+	return b.boot + "-" + strconv.FormatUint(seq, 10)
+}
+
+// cursor turns the last ID a client saw into the sequence number to
+// continue after. An empty ID starts after the newest event. An ID that is
+// malformed or from another process starts before everything still
+// buffered and reports ok=false.
+func (b *replayBuffer) cursor(lastID string) (seq uint64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastID == "" {
+		return b.next - 1, true
+	}
+	boot, s, found := strings.Cut(lastID, "-")
+	n, err := strconv.ParseUint(s, 10, 64)
+	if !found || err != nil || boot != b.boot || n >= b.next {
+		return 0, false
+	}
+	return n, true
+}
+
+// after returns the buffered events following seq, whether some of them
+// have already been dropped from the buffer, and a channel that is closed
+// by the next append.
+func (b *replayBuffer) after(seq uint64) ([]streamEvent, bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := sort.Search(len(b.events), func(i int) bool { return b.events[i].seq > seq })
+	events := append([]streamEvent(nil), b.events[i:]...)
+	gap := len(b.events) > 0 && b.events[0].seq > seq+1
+	return events, gap, b.wake
+}
+
+// ---------------- STREAM FILTER ----------------
+
+// streamFilter selects the events an SSE or long-poll client receives: the
+// alerts its token grants, narrowed by the query, e.g.
+//
+//	/api/alerts/stream?alert=disk_full&label=team=db
+type streamFilter struct {
+	grants []alertGrant
+	sub    Subscription
+}
+
+func newStreamFilter(w http.ResponseWriter, r *http.Request) (streamFilter, bool) {
+	acc := accessFrom(r.Context())
+	if acc == nil {
+		http.Error(w, "Access Denied", http.StatusForbidden)
+		return streamFilter{}, false
+	}
+	grants, err := acc.alertGrants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return streamFilter{}, false
+	}
+
+	q := r.URL.Query()
+	f := streamFilter{grants: grants, sub: Subscription{Alerts: q["alert"]}}
+	for _, l := range q["label"] {
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || k == "" {
+			http.Error(w, fmt.Sprintf("Invalid label filter %q, want name=value", l), http.StatusBadRequest)
+			return streamFilter{}, false
+		}
+		if f.sub.Labels == nil {
+			f.sub.Labels = make(map[string]string)
+		}
+		f.sub.Labels[k] = v
+	}
+	return f, true
+}
+
+func (f streamFilter) wants(e AlertEvent) bool {
+	return granted(f.grants, e) && f.sub.matches(e)
+}
+
+// lastEventID returns where the client wants to resume: the Last-Event-ID
+// header EventSource sends on reconnect, or the since query parameter.
+func lastEventID(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("since")
+}
+
+// ---------------- SERVER-SENT EVENTS ----------------
+
+// alertStreamPath is where ServeSSE is mounted. EventSource cannot send
+// headers either, so the token may be passed as ?access_token= there.
+const alertStreamPath = "/api/alerts/stream"
+
+// ServeSSE streams alerts as Server-Sent Events. Each event carries the
+// same JSON envelope as a WebSocket alert frame. Like ServeWS it must be
+// mounted behind Authenticator.Require.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	filter, ok := newStreamFilter(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := lastEventID(r)
+	seq, known := h.replay.cursor(lastID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	if !known {
+		writeSSE(w, "", "error", encodeErrorMessage("unknown event id %q, replaying buffered events", lastID))
+	}
+	flusher.Flush()
+
+	var expired <-chan time.Time
+	if acc := accessFrom(r.Context()); !acc.Expires.IsZero() {
+		timer := time.NewTimer(time.Until(acc.Expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		events, gap, wake := h.replay.after(seq)
+		if gap && known {
+			writeSSE(w, "", "error", encodeErrorMessage("events after %q were dropped from the replay buffer", h.replay.id(seq)))
+		}
+		known = true
+		for _, ev := range events {
+			seq = ev.seq
+			if !filter.wants(ev.event) {
+				continue
+			}
+			msg, err := encodeAlertMessage(ev.event)
+			if err != nil {
+				continue
+			}
+			writeSSE(w, h.replay.id(ev.seq), "alert", msg)
+		}
+		flusher.Flush()
+
+		select {
+		case <-wake:
+		case <-ticker.C:
+			// Comment lines keep idle proxies from closing the stream.
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-expired:
+			writeSSE(w, "", "error", encodeErrorMessage("token expired"))
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, id, event string, data []byte) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// ---------------- LONG POLL ----------------
+
+type pollEvent struct {
+	ID    string       `json:"id"`
+	Alert AlertPayload `json:"alert"`
+}
+
+type pollResponse struct {
+	Version int         `json:"version"`
+	Events  []pollEvent `json:"events"`
+	Next    string      `json:"next"`            // pass as since on the next poll
+	Reset   bool        `json:"reset,omitempty"` // some events were missed
+}
+
+// ServePoll answers
+//
+//	GET /api/alerts/poll?since=<id>&timeout=30s
+//
+// with the alerts after since, waiting up to timeout for the first one.
+// Without since it waits for the next alert. Like ServeWS it must be
+// mounted behind Authenticator.Require.
+func (h *Hub) ServePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filter, ok := newStreamFilter(w, r)
+	if !ok {
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if s := r.URL.Query().Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	seq, known := h.replay.cursor(lastEventID(r))
+	resp := pollResponse{Version: protocolVersion, Events: []pollEvent{}, Reset: !known}
+
+wait:
+	for {
+		events, gap, wake := h.replay.after(seq)
+		resp.Reset = resp.Reset || gap
+		for _, ev := range events {
+			seq = ev.seq
+			if filter.wants(ev.event) {
+				resp.Events = append(resp.Events, pollEvent{ID: h.replay.id(ev.seq), Alert: newAlertPayload(ev.event)})
+			}
+		}
+		if len(resp.Events) > 0 || resp.Reset {
+			break
+		}
+
+		select {
+		case <-wake:
+		case <-deadline.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	resp.Next = h.replay.id(seq)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
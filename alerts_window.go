@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------- METRIC HISTORY ----------------
+
+// maxHistoryWindow bounds the longest window a rule may use, and with it
+// the samples kept per series: 4096 at the evaluation interval.
+const maxHistoryWindow = 4096 * evaluationInterval
+
+type sample struct {
+	t time.Time
+	v float64
+}
+
+// ring is a buffer of samples in time order. It grows when full, so it
+// holds whatever the caller has not trimmed.
+type ring struct {
+	buf   []sample
+	start int
+	n     int
+}
+
+// newRing returns a ring sized for window at the evaluation interval.
+// Denser samples, as in a backtest, grow it.
+func newRing(window time.Duration) *ring {
+	return &ring{buf: make([]sample, int(window/evaluationInterval)+1)}
+}
+
+func (r *ring) at(i int) sample {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+func (r *ring) push(s sample) {
+	if r.n == len(r.buf) {
+		buf := make([]sample, 2*len(r.buf))
+		for i := 0; i < r.n; i++ {
+			buf[i] = r.at(i)
+		}
+		r.buf, r.start = buf, 0
+	}
+	r.buf[(r.start+r.n)%len(r.buf)] = s
+	r.n++
+}
+
+// trim drops samples older than t.
+func (r *ring) trim(t time.Time) {
+	for r.n > 0 && r.at(0).t.Before(t) {
+		r.start = (r.start + 1) % len(r.buf)
+		r.n--
+	}
+}
+
+// since returns a copy of the samples at or after t.
+func (r *ring) since(t time.Time) []sample {
+	var out []sample
+	for i := 0; i < r.n; i++ {
+		if s := r.at(i); !s.t.Before(t) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// MetricHistory keeps recent samples of the metrics that windowed functions
+// refer to, each for as long as the longest window over it.
+type MetricHistory struct {
+	mu     sync.Mutex
+	series map[string]*ring
+}
+
+func NewMetricHistory() *MetricHistory {
+	return &MetricHistory{series: make(map[string]*ring)}
+}
+
+// Record appends the current value of every series whose metric name is in
+// windows, keyed by series, and forgets series that have aged out.
+func (h *MetricHistory) Record(windows map[string]time.Duration, idx seriesIndex, metrics map[string]float64, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for name, window := range windows {
+		for _, s := range idx[name] {
+			r, ok := h.series[s.key]
+			if !ok {
+				r = newRing(window)
+				h.series[s.key] = r
+			}
+			// Trim first so a ring already sized for its window does not
+			// grow for one more sample.
+			r.trim(now.Add(-window))
+			r.push(sample{t: now, v: metrics[s.key]})
+		}
+	}
+
+	for key, r := range h.series {
+		name, _, _ := parseSeriesKey(key)
+		window, ok := windows[name]
+		if ok {
+			r.trim(now.Add(-window))
+		}
+		if !ok || r.n == 0 {
+			delete(h.series, key)
+		}
+	}
+}
+
+// Range returns the samples of the series key within window before now.
+func (h *MetricHistory) Range(key string, window time.Duration, now time.Time) []sample {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r, ok := h.series[key]
+	if !ok {
+		return nil
+	}
+	return r.since(now.Add(-window))
+}
+
+// ---------------- RANGE FUNCTIONS ----------------
+
+type rangeFunc struct {
+	extraArgs  int
+	minSamples int
+	call       func(samples []sample, now time.Time, args []float64) float64
+}
+
+var rangeFuncs = map[string]rangeFunc{
+	"rate":          {0, 2, rangeRate},
+	"increase":      {0, 2, rangeIncrease},
+	"avg_over_time": {0, 1, rangeAvg},
+	"min_over_time": {0, 1, rangeMin},
+	"max_over_time": {0, 1, rangeMax},
+	"predict_linear": {1, 2, func(s []sample, now time.Time, a []float64) float64 {
+		slope, intercept := linearRegression(s, now)
+		return intercept + slope*a[0]
+	}},
+}
+
+// rangeIncrease treats any drop as a counter reset.
+func rangeIncrease(s []sample, now time.Time, _ []float64) float64 {
+	var inc float64
+	for i := 1; i < len(s); i++ {
+		if d := s[i].v - s[i-1].v; d >= 0 {
+			inc += d
+		} else {
+			inc += s[i].v
+		}
+	}
+	return inc
+}
+
+// rangeRate is the per-second increase across the samples.
+func rangeRate(s []sample, now time.Time, args []float64) float64 {
+	elapsed := s[len(s)-1].t.Sub(s[0].t).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return rangeIncrease(s, now, args) / elapsed
+}
+
+func rangeAvg(s []sample, _ time.Time, _ []float64) float64 {
+	var sum float64
+	for _, x := range s {
+		sum += x.v
+	}
+	return sum / float64(len(s))
+}
+
+func rangeMin(s []sample, _ time.Time, _ []float64) float64 {
+	m := s[0].v
+	for _, x := range s[1:] {
+		m = math.Min(m, x.v)
+	}
+	return m
+}
+
+func rangeMax(s []sample, _ time.Time, _ []float64) float64 {
+	m := s[0].v
+	for _, x := range s[1:] {
+		m = math.Max(m, x.v)
+	}
+	return m
+}
+
+// linearRegression fits v = intercept + slope*(t-now) by least squares, with
+// t in seconds, so intercept is the fitted value at now.
+func linearRegression(s []sample, now time.Time) (slope, intercept float64) {
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(s))
+	for _, x := range s {
+		dx := x.t.Sub(now).Seconds()
+		sumX += dx
+		sumY += x.v
+		sumXY += dx * x.v
+		sumXX += dx * dx
+	}
+	den := n*sumXX - sumX*sumX
+	if den == 0 {
+		return 0, sumY / n
+	}
+	slope = (n*sumXY - sumX*sumY) / den
+	intercept = (sumY - slope*sumX) / n
+	return slope, intercept
+}
+
+// rangeCallExpr is a function over the recent history of one series, e.g.
+// avg_over_time(cpu[5m]).
+type rangeCallExpr struct {
+	name   string
+	fn     rangeFunc
+	sel    *metricExpr
+	window time.Duration
+	text   string // window as written
+	args   []Expr
+}
+
+type insufficientHistoryError struct {
+	expr string
+}
+
+func (e *insufficientHistoryError) Error() string {
+	return "not enough history yet for " + e.expr
+}
+
+func (c *rangeCallExpr) Eval(env *evalEnv) (float64, error) {
+	key, ok := env.resolve(c.sel)
+	if !ok {
+		return 0, &missingMetricError{name: seriesKey(c.sel.String(), env.instance)}
+	}
+	samples := env.history.Range(key, c.window, env.now)
+	if len(samples) < c.fn.minSamples {
+		return 0, &insufficientHistoryError{expr: c.String()}
+	}
+
+	args := make([]float64, len(c.args))
+	for i, a := range c.args {
+		v, err := a.Eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return c.fn.call(samples, env.now, args), nil
+}
+
+func (c *rangeCallExpr) String() string {
+	parts := []string{fmt.Sprintf("%s[%s]", c.sel, c.text)}
+	for _, a := range c.args {
+		parts = append(parts, a.String())
+	}
+	return c.name + "(" + strings.Join(parts, ", ") + ")"
+}
+
+func (p *parser) parseRangeCall(name token, fn rangeFunc) (Expr, error) {
+	p.next() // (
+
+	m := p.next()
+	if m.kind != tokIdent {
+		return nil, fmt.Errorf("at %d: %s expects a metric with a range, e.g. cpu[5m]", m.pos, name.text)
+	}
+	r := p.next()
+	if r.kind != tokRange {
+		return nil, fmt.Errorf("at %d: %s expects a range after %s, e.g. %s[5m]", r.pos, name.text, m.text, m.text)
+	}
+
+	var args []Expr
+	for p.peek().kind == tokComma {
+		p.next()
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	if c := p.next(); c.kind != tokRParen {
+		return nil, fmt.Errorf("at %d: expected ')' after arguments to %s", c.pos, name.text)
+	}
+	if len(args) != fn.extraArgs {
+		return nil, fmt.Errorf("at %d: wrong number of arguments to %s", name.pos, name.text)
+	}
+
+	return &rangeCallExpr{
+		name:   strings.ToLower(name.text),
+		fn:     fn,
+		sel:    &metricExpr{name: m.text, matchers: m.matchers},
+		window: r.window,
+		text:   r.text,
+		args:   args,
+	}, nil
+}
+
+// exprWindows records, per metric, the longest window e looks back over.
+func exprWindows(e Expr, out map[string]time.Duration) {
+	switch n := e.(type) {
+	case *unaryExpr:
+		exprWindows(n.x, out)
+	case *binaryExpr:
+		exprWindows(n.l, out)
+		exprWindows(n.r, out)
+	case *callExpr:
+		for _, a := range n.args {
+			exprWindows(a, out)
+		}
+	case *rangeCallExpr:
+		if n.window > out[n.sel.name] {
+			out[n.sel.name] = n.window
+		}
+		for _, a := range n.args {
+			exprWindows(a, out)
+		}
+	}
+}
+
+func (r Rule) collectWindows(out map[string]time.Duration) {
+	if r.expr != nil {
+		exprWindows(r.expr, out)
+	}
+	for _, sub := range r.And {
+		sub.collectWindows(out)
+	}
+	for _, sub := range r.Or {
+		sub.collectWindows(out)
+	}
+}
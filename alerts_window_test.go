@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRangeFunctions(t *testing.T) {
+	h := NewMetricHistory()
+	windows := map[string]time.Duration{"net.rx_bytes": 5 * time.Minute, "disk.used": 5 * time.Minute}
+	start := time.Unix(1700000000, 0)
+	rx := []float64{100, 160, 220, 10, 70} // the counter resets at minute 3
+	var metrics map[string]float64
+	for i, v := range rx {
+		metrics = map[string]float64{
+			"net.rx_bytes": v,
+			"disk.used":    float64(10 * (i + 1)),
+		}
+		h.Record(windows, buildSeriesIndex(metrics), metrics, start.Add(time.Duration(i)*time.Minute))
+	}
+	env := &evalEnv{metrics: metrics, index: buildSeriesIndex(metrics), history: h, now: start.Add(4 * time.Minute)}
+
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"increase(net.rx_bytes[5m])", 190},
+		{"rate(net.rx_bytes[5m])", 190.0 / 240},
+		{"rate(net.rx_bytes[90s])", 60.0 / 60},
+		{"avg_over_time(disk.used[5m])", 30},
+		{"min_over_time(disk.used[5m])", 10},
+		{"max_over_time(disk.used[2m])", 50},
+		{"predict_linear(disk.used[5m], 3600)", 650},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", tt.src, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	e, _ := parseExpr("rate(net.rx_bytes[30s])")
+	var insufficient *insufficientHistoryError
+	if _, err := e.Eval(env); !errors.As(err, &insufficient) {
+		t.Errorf("rate over one sample: error %v, want insufficient history", err)
+	}
+}
+
+func TestMetricHistoryTrims(t *testing.T) {
+	h := NewMetricHistory()
+	windows := map[string]time.Duration{"cpu": 2 * time.Minute}
+	start := time.Unix(1700000000, 0)
+	for i := 0; i <= 10; i++ {
+		metrics := map[string]float64{"cpu": float64(i), "load1": 1}
+		h.Record(windows, buildSeriesIndex(metrics), metrics, start.Add(time.Duration(i)*time.Minute))
+	}
+	now := start.Add(10 * time.Minute)
+
+	got := h.Range("cpu", time.Hour, now)
+	if len(got) != 3 || got[0].v != 8 || got[2].v != 10 {
+		t.Errorf("cpu history = %v, want minutes 8 to 10", got)
+	}
+	if got := h.Range("load1", time.Hour, now); got != nil {
+		t.Errorf("load1 kept without a window over it: %v", got)
+	}
+
+	metrics := map[string]float64{"cpu": 11}
+	h.Record(map[string]time.Duration{}, buildSeriesIndex(metrics), metrics, now.Add(time.Minute))
+	if got := h.Range("cpu", time.Hour, now); got != nil {
+		t.Errorf("cpu kept after its window was removed: %v", got)
+	}
+}
+
+func TestCompileRejectsWindowsBeyondHistory(t *testing.T) {
+	tests := []struct {
+		condition string
+		ok        bool
+	}{
+		{"rate(net.rx_bytes[5h]) > 1", true},
+		{"rate(net.rx_bytes[0.2d]) > 1", true},
+		{"rate(net.rx_bytes[6h]) > 1", false},
+		{"avg_over_time(cpu[1d]) > 1", false},
+	}
+	for _, tt := range tests {
+		cfg := Config{Alerts: []Alert{{Name: "a", Rule: Rule{Condition: tt.condition}}}}
+		err := compileConfig(&cfg)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.condition, err)
+		}
+		if !tt.ok && (err == nil || !strings.Contains(err.Error(), "history kept")) {
+			t.Errorf("%s: error %v, want the window rejected", tt.condition, err)
+		}
+	}
+}
+
+func TestMetricHistoryDenseSamples(t *testing.T) {
+	h := NewMetricHistory()
+	windows := map[string]time.Duration{"cpu": time.Hour}
+	start := time.Unix(1700000000, 0)
+	var now time.Time
+	for i := 0; i <= 2*3600; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		metrics := map[string]float64{"cpu": float64(i)}
+		h.Record(windows, buildSeriesIndex(metrics), metrics, now)
+	}
+
+	got := h.Range("cpu", time.Hour, now)
+	if len(got) != 3601 || got[0].v != 3600 || got[len(got)-1].v != 7200 {
+		t.Errorf("cpu history has %d samples from %v, want the last hour at 1s", len(got), got[0].v)
+	}
+	if c := len(h.series["cpu"].buf); c > 2*3601 {
+		t.Errorf("ring capacity %d for 3601 samples", c)
+	}
+}